@@ -4,9 +4,14 @@ import (
 	"archive/tar"
 	"bufio"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,80 +20,138 @@ import (
 type tarchive struct {
 	// tar
 	dstName string
-	dst     *os.File
-	writer  *tar.Writer
+	sz      *parallelWriter
+	// The tar stream, written to `sz` and, with --verify, hashed.
+	raw    io.Writer
+	writer *tar.Writer
 	// Map inodes to hardlinks.
 	hardlinks map[uint64]string
 
 	// untar
 	srcName string
-	src     *os.File
 	reader  *tar.Reader
+	guard   *bombGuard
+	// The members to extract, or nil for every member.
+	members *memberMatcher
+	// Directories whose permissions and timestamps are restored
+	//   once everything inside them has been extracted.
+	dirs []extractedDir
+	// Map user and group names to local ids.
+	uids map[string]int
+	gids map[string]int
 }
 
-// https://github.com/docker/docker/blob/master/pkg/archive/archive.go
-// Create a tar archive of a directory.
-func tarDir(src *os.File) (string, error) {
-
-	// Get file info for the source directory.
-	srcInfo, err := src.Stat()
-	if err != nil {
-		return "", err
-	}
+// extractedDir is a directory extracted from a tar archive.
+type extractedDir struct {
+	hdr  *tar.Header
+	name string
+}
 
-	srcName := src.Name()
-	srcMode := srcInfo.Mode()
-	baseName := filepath.Base(srcName)
-	dstName := concat(baseName, ".tar")
-	setDstName(&dstName)
+// https://github.com/docker/docker/blob/master/pkg/archive/archive.go
+// Create a tar archive of a directory
+//   and write it to `dst` as a snappy stream.
+// The archive is compressed as it is written,
+//   so no temporary tar archive is needed.
+// If `h` is not nil, hash the uncompressed archive into it, for --verify.
+func tarDir(dst io.Writer, srcName string, dstName string, h hash.Hash) error {
 
 	t := &tarchive{}
+	t.create(dst, dstName, h)
+	defer t.close()
 
-	err = t.create(dstName, srcMode)
-	if err != nil {
-		return "", err
+	if err := t.tar(srcName, filepath.Base(srcName)); err != nil {
+		return err
 	}
 
+	// Flush the end of the archive.
+	return t.close()
+}
+
+// Create a tar archive of several files and directories
+//   and write it to `dst` as a snappy stream.
+// Each one keeps the path it was given by,
+//   less any leading "/" or "../", like GNU tar does.
+// If `h` is not nil, hash the uncompressed archive into it, for --verify.
+func tarFiles(dst io.Writer, srcNames []string, dstName string, h hash.Hash) error {
+
+	t := &tarchive{}
+	t.create(dst, dstName, h)
 	defer t.close()
 
-	err = t.tar(srcName)
-	if err != nil {
-		return "", err
+	for _, srcName := range srcNames {
+		if err := t.tar(srcName, memberName(srcName)); err != nil {
+			return err
+		}
 	}
 
-	return dstName, nil
+	// Flush the end of the archive.
+	return t.close()
 }
 
-// prepare to tar
-func (t *tarchive) create(dstName string, mode os.FileMode) error {
+// Return the name a file given by the user should have in an archive.
+// Names can't be absolute or point outside of the archive,
+//   so warn about and remove anything which would.
+func memberName(srcName string) string {
 
-	dst, err := create(dstName, mode)
-	if err != nil {
-		return err
+	name := strings.TrimPrefix(srcName, filepath.VolumeName(srcName))
+	name = filepath.ToSlash(filepath.Clean(name))
+
+	trimmed := name
+	for {
+		next := strings.TrimPrefix(strings.TrimPrefix(trimmed, "/"), "../")
+		if next == trimmed {
+			break
+		}
+		trimmed = next
+	}
+	if trimmed == ".." || trimmed == "" {
+		trimmed = "."
 	}
 
-	var dstWriteCloser io.WriteCloser = dst
+	if trimmed != name {
+		printWarning(srcName, fmt.Errorf("removing leading %q from member names",
+			strings.TrimSuffix(name, trimmed)))
+	}
+
+	return trimmed
+}
 
+// prepare to tar
+// The snappy writer buffers data so that every chunk is compressed
+//   from a full block instead of from each small write made by the
+//   tar writer, which would lower the compression ratio.
+// If `h` is not nil, the tar writer's output is hashed into it too.
+func (t *tarchive) create(dst io.Writer, dstName string, h hash.Hash) {
 	t.dstName = dstName
-	t.dst = dst
-	t.writer = tar.NewWriter(dstWriteCloser)
+	t.sz = newParallelWriter(dst, runtime.GOMAXPROCS(0))
+	t.sz.indexed = DoSeekable
+	t.raw = t.sz
+	if h != nil {
+		t.raw = io.MultiWriter(t.sz, h)
+	}
+	t.writer = tar.NewWriter(t.raw)
 	t.hardlinks = make(map[uint64]string)
-
-	return nil
 }
 
-// Walk through the directory.
-// Add a header to the tar archive for each file encountered.
-func (t *tarchive) tar(srcName string) error {
+// Walk through the directory, or the single file, `srcName`,
+//   naming it `name` in the archive.
+// Add a header to the tar archive for each file encountered,
+//   except for any the user excluded.
+func (t *tarchive) tar(srcName string, name string) error {
 
 	dstName := t.dstName
 	var total int
 	var progress int
 	var start time.Time
-	parent := filepath.Dir(srcName)
+
+	// Leave out whatever the user asked to exclude.
+	walker := newExcluder(srcName, name)
 
 	if !DoQuiet {
-		total = dirSize(srcName)
+		walker.walk(func(path string, fi os.FileInfo, err error) error {
+			total++
+			return nil
+		})
 	}
 
 	if !DoQuiet {
@@ -96,18 +159,25 @@ func (t *tarchive) tar(srcName string) error {
 		defer print()
 	}
 
-	return filepath.Walk(srcName, func(path string, fi os.FileInfo, err error) error {
+	return walker.walk(func(path string, fi os.FileInfo, err error) error {
 		// Quit if any errors occur.
 		if err != nil {
 			return err
 		}
 
+		// Tar archives can't hold sockets,
+		//   and they are recreated by whatever listens on them anyway.
+		if fi.Mode()&os.ModeSocket != 0 {
+			printWarning(path, fmt.Errorf("socket ignored"))
+			return nil
+		}
+
 		// Don't use the full path of the file in its header name.
 		// Otherwise, the archive may extract an unnecessarily long path with
 		//   anoying, empty diretories.
 		// E.g., make an archive of '/home/me/Documents' extract to
 		//   'Documents', not to '/home/me/Documents'.
-		name, err := filepath.Rel(parent, path)
+		name, err := walker.memberName(path)
 		if err != nil {
 			return err
 		}
@@ -169,6 +239,17 @@ func (t *tarchive) header(path, name string) (*tar.Header, error) {
 		return nil, err
 	}
 
+	// Record the owner chosen by the user, if any.
+	if Owner != nil {
+		hdr.Uid, hdr.Uname = Owner.id, Owner.name
+	}
+	if Group != nil {
+		hdr.Gid, hdr.Gname = Group.id, Group.name
+	}
+	if DoNumericOwner {
+		hdr.Uname, hdr.Gname = "", ""
+	}
+
 	// Set the header name.
 	// If the file is a directory, add a trailing "/".
 	if isDir := (fi.Mode()&os.ModeDir != 0); isDir {
@@ -206,277 +287,686 @@ func (t *tarchive) header(path, name string) (*tar.Header, error) {
 		}
 	}
 
-	// Find any security.capability xattrs and set the header accordingly.
-	capability, _ := lgetxattr(path, "security.capability")
-	if capability != nil {
-		hdr.Xattrs = make(map[string]string)
-		hdr.Xattrs["security.capability"] = string(capability)
+	// Store the file's xattrs, e.g., its capabilities or ACLs.
+	if err := t.headerXattrs(hdr, path); err != nil {
+		return nil, err
 	}
 
 	return hdr, nil
 }
 
-func (t *tarchive) write(hdr *tar.Header, path string) error {
+// PAX record key prefix for xattrs, as used by GNU tar and star.
+const paxXattr = "SCHILY.xattr."
 
-	// Write the header.
-	tw := t.writer
-	if err := tw.WriteHeader(hdr); err != nil {
+// Add every xattr of a file to its header as a PAX record.
+func (t *tarchive) headerXattrs(hdr *tar.Header, path string) error {
+
+	if !DoXattrs {
+		return nil
+	}
+
+	attrs, err := llistxattr(path)
+	if err != nil {
 		return err
 	}
 
+	for _, attr := range attrs {
+		if !xattrIncluded(attr) {
+			continue
+		}
+
+		value, err := lgetxattr(path, attr)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			// The xattr was removed after it was listed.
+			continue
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[concat(paxXattr, attr)] = string(value)
+	}
+
+	return nil
+}
+
+// Check whether an xattr should be archived or restored,
+//   according to --xattrs-include and --xattrs-exclude.
+func xattrIncluded(attr string) bool {
+
+	if !DoXattrs {
+		return false
+	}
+
+	for _, pattern := range XattrsExclude {
+		if xattrMatch(pattern, attr) {
+			return false
+		}
+	}
+
+	if len(XattrsInclude) == 0 {
+		return true
+	}
+	for _, pattern := range XattrsInclude {
+		if xattrMatch(pattern, attr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether an xattr name matches a pattern.
+// A pattern with no "." or "*" names a namespace, e.g.,
+//   "user" matches "user.comment".
+// Otherwise, it is matched as a shell pattern, e.g., "system.posix_acl_*".
+func xattrMatch(pattern string, attr string) bool {
+
+	if !strings.ContainsAny(pattern, ".*") {
+		return strings.HasPrefix(attr, concat(pattern, "."))
+	}
+
+	matched, _ := filepath.Match(pattern, attr)
+	return matched
+}
+
+// Restore the xattrs stored in a header to an extracted file.
+// Some xattrs can only be set by root, or on some filesystems,
+//   so warn about any which can't be set instead of failing.
+func restoreXattrs(hdr *tar.Header, name string) {
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattr) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattr)
+		if !xattrIncluded(attr) {
+			continue
+		}
+
+		if err := lsetxattr(name, attr, []byte(value)); err != nil {
+			printWarning(hdr.Name, fmt.Errorf("cannot restore xattr %v: %v", attr, err))
+		}
+	}
+}
+
+func (t *tarchive) write(hdr *tar.Header, path string) error {
+
 	// If the file is not a regular one,
 	// i.e., a symlink, directory, or hardlink,
 	// skip adding its contents to the archive (since it does not have any).
 	if hdr.Typeflag != tar.TypeReg {
-		return nil
+		return t.writer.WriteHeader(hdr)
 	}
 
-	// Write the file's contents to the archive.
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	// If the file has holes, e.g., a disk image, archive only its data.
+	data, err := sparseData(file, hdr.Size)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		return t.writeSparse(hdr, file, data)
+	}
+
+	// Write the header.
+	tw := t.writer
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
 
+	// Write the file's contents to the archive.
 	// tb := t.bufioWriter
 	// var tb *bufio.Writer
 	// tb.Reset(tw)
 	tb := bufio.NewWriter(tw)
 	defer tb.Reset(nil)
 
-	_, err = io.Copy(tb, file)
-	file.Close()
-	if err != nil {
+	if _, err := io.Copy(tb, file); err != nil {
 		return err
 	}
 
 	return tb.Flush()
 }
 
-// Extract a tar archive.
-func untar(src *os.File) (string, error) {
+// Extract a tar archive from a stream.
+// The archive is extracted into a hidden, temporary directory
+//   and moved into place only once every entry has been extracted,
+//   so a failed extraction leaves nothing behind under its final name.
+// `guard` stops the extraction once the archive passes any limit.
+func untar(srcName string, r io.Reader, guard *bombGuard) (string, error) {
+	return untarMembers(srcName, r, guard, nil)
+}
 
-	srcName := src.Name()
+// Extract the members of a tar archive which `members` matches,
+//   or every member if it is nil, like untar does.
+func untarMembers(srcName string, r io.Reader, guard *bombGuard, members *memberMatcher) (string, error) {
 
-	t := &tarchive{}
+	t := &tarchive{guard: guard, members: members}
+	t.open(srcName, r)
+	defer t.close()
 
-	err := t.open(srcName)
+	// The first header holds the top directory.
+	hdr, err := t.next()
+	if err == io.EOF && members != nil {
+		err = members.notFound()
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("empty tar archive")
+	}
 	if err != nil {
 		return "", err
 	}
 
-	defer t.close()
+	dstName := topDir(hdr.Name)
+	setDstName(&dstName)
 
-	// Get the smallest directory name (top directory).
-	headName, err := t.headName()
+	tmpDir, err := mkdirTemp(dstName)
 	if err != nil {
 		return "", err
 	}
+	defer removeTemp(tmpDir)
 
-	// Make sure existing files are not overwritten.
-	dstName := headName
-	setDstName(&dstName)
+	roots, err := t.untar(hdr, tmpDir, dstName)
+	if err != nil {
+		return "", err
+	}
 
-	err = t.untar(dstName, headName)
+	movedFrom, dstName, err := moveExtracted(srcName, tmpDir, roots)
 	if err != nil {
-		return "", fmt.Errorf("%v\nFailed to extract %v", err, srcName)
+		return "", err
 	}
 
+	// Restore directories only once they are in place,
+	//   since a read-only directory can't be moved to a new parent.
+	t.restoreDirs(movedFrom, dstName)
+
 	return dstName, nil
 }
 
 // prepare to untar
-func (t *tarchive) open(srcName string) error {
+func (t *tarchive) open(srcName string, r io.Reader) {
+	t.srcName = srcName
+	t.reader = tar.NewReader(r)
+}
 
-	src, err := os.Open(srcName)
-	if err != nil {
-		return err
+// Return the header of the next member to extract.
+// Return io.EOF at the end of the archive,
+//   or once every member requested by name has been found.
+func (t *tarchive) next() (*tar.Header, error) {
+	for {
+		if t.members != nil && t.members.done() {
+			return nil, io.EOF
+		}
+		hdr, err := t.reader.Next()
+		if err != nil || t.members == nil || t.members.match(hdr) {
+			return hdr, err
+		}
 	}
+}
 
-	t.srcName = srcName
-	t.src = src
-	t.reader = tar.NewReader(src)
+// Write the contents of the regular files in a tar archive
+//   which `members` matches, or of every one if it is nil, to `w`.
+func catMembers(w io.Writer, r io.Reader, guard *bombGuard, members *memberMatcher) error {
 
-	return nil
+	t := &tarchive{guard: guard, members: members}
+	t.open("", r)
+	defer t.close()
+
+	for {
+		hdr, err := t.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := t.guard.checkEntry(hdr); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeCont, tar.TypeGNUSparse:
+			if _, err := io.Copy(w, t.reader); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-// Search a tar file for the top-level directory to be extracted.
-func (t *tarchive) headName() (string, error) {
+// Return the first element of a header name,
+//   i.e., the top directory of the archive.
+func topDir(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	return strings.SplitN(name, "/", 2)[0]
+}
+
+// Extract a tar archive into `tmpDir`, starting from its first header.
+// Return the top-level names of the archive, in order.
+func (t *tarchive) untar(hdr *tar.Header, tmpDir string, dstName string) ([]string, error) {
 
-	tr := t.reader
 	srcName := t.srcName
 
-	var headName string
-	var err error
+	var roots []string
+	seen := make(map[string]bool)
 
-	defer func() {
-		t.close()
-		t.open(srcName)
-	}()
+	if !DoQuiet {
+		print(concat(srcName, "  >  ", dstName))
+	}
 
-	// Get the smallest directory name (top directory).
+	// Extract the archive.
 	for {
-		var hdr *tar.Header
-		hdr, err = tr.Next()
+		if err := t.guard.checkEntry(hdr); err != nil {
+			return nil, err
+		}
+		name, err := t.extract(hdr, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			t.restore(hdr, name)
+		}
 
-		// Break if the end of the tar archive has been reached.
+		if root := topDir(hdr.Name); root != "" && !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+
+		hdr, err = t.next()
+
+		// Stop if the end of the tar archive has been reached.
+		if err == io.EOF {
+			return roots, nil
+		}
 		if err != nil {
-			if done := (err == io.EOF); done {
-				err = nil
-			}
-			break
+			return nil, err
+		}
+	}
+}
+
+// Extract a single header from a tar archive into `tmpDir`.
+// Return the name it was extracted to,
+//   or "" if it has no metadata of its own to restore,
+//   i.e., it is a hard link or was skipped.
+func (t *tarchive) extract(hdr *tar.Header, tmpDir string) (string, error) {
+
+	tr := t.reader
+
+	name, err := safePath(tmpDir, hdr.Name)
+	if err != nil {
+		return "", err
+	}
+
+	// Archives need not list the directories their files are in,
+	//   e.g., ones bundled from files given by the user.
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+
+	// Make sure existing files are not overwritten.
+	// Directories may be extracted into, though,
+	//   since the archive may list them more than once.
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// Extract a directory.
+		// Make sure it can be extracted into,
+		//   even if its own permissions don't allow that.
+		// They are restored once everything inside it has been extracted.
+		// A symlink extracted earlier must not stand in for it,
+		//   or its permissions would be restored to the link's target.
+		if fi, err := os.Lstat(name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q: it is a symlink", hdr.Name)
 		}
+		err = os.MkdirAll(name, os.FileMode(hdr.Mode)|0700)
 
-		// Set headName to the very first header name.
-		// Most likely, this will be the name of the top directory anyway.
-		if headName == "" {
-			headName = hdr.Name
+	case tar.TypeReg, tar.TypeRegA, tar.TypeCont, tar.TypeGNUSparse:
+		// Extract a regular file.
+		// The tar reader fills in the holes of a sparse file.
+		var w *os.File
+		w, _, err = create(name, os.FileMode(hdr.Mode))
+		if err != nil {
+			return "", err
+		}
+		name = w.Name()
+		dst, finish := contentWriter(w)
+		// With --verify, hash the contents to check the new file against.
+		var src io.Reader = tr
+		h := newVerifyHash()
+		if h != nil {
+			src = io.TeeReader(tr, h)
+		}
+		_, err = io.Copy(dst, src)
+		if finishErr := finish(); err == nil {
+			err = finishErr
+		}
+		if err == nil {
+			err = verifyWritten(w, h)
+		}
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
 		}
 
-		// Skip non-directories.
-		if hdr.Typeflag != tar.TypeDir {
-			continue
+	case tar.TypeLink:
+		// Extract a hard link.
+		// Its target is named relative to the top of the archive.
+		target, err := safePath(tmpDir, hdr.Linkname)
+		if err != nil {
+			return "", err
+		}
+		// Some systems link to whatever a symlink points to.
+		fi, err := os.Lstat(target)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q: it links to a symlink", hdr.Name)
+		}
+		if os.IsNotExist(err) && t.members != nil {
+			return "", fmt.Errorf("cannot extract %q: it links to %q, which was not extracted", hdr.Name, hdr.Linkname)
 		}
+		// A hard link shares its target's metadata.
+		_, err = claimUnusedPath(name, func(name string) error {
+			return os.Link(target, name)
+		})
+		return "", err
 
-		// The top directory is the shortest path and has the shortest name.
-		if higher := (len(hdr.Name) < len(headName)); higher {
-			headName = hdr.Name
+	case tar.TypeSymlink:
+		// Extract a symlink.
+		name, err = claimUnusedPath(name, func(name string) error {
+			return os.Symlink(hdr.Linkname, name)
+		})
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// Extract a device node or FIFO.
+		// Only root can create device nodes,
+		//   so warn about any which can't be created instead of failing.
+		name, err = claimUnusedPath(name, func(name string) error {
+			return mknod(name, hdr)
+		})
+		if err != nil {
+			printWarning(hdr.Name, fmt.Errorf("cannot extract %v: %v", headerType(hdr), err))
+			return "", nil
 		}
-	}
 
+	case tar.TypeXGlobalHeader:
+		// A global PAX header holds no file of its own.
+		return "", nil
+
+	default:
+		// E.g., a GNU multi-volume continuation or a corrupt header.
+		printWarning(hdr.Name, fmt.Errorf("cannot extract entry of unknown type %q", hdr.Typeflag))
+		return "", nil
+	}
 	if err != nil {
 		return "", err
 	}
 
-	// If no names were found, the data is corrupt.
-	if noHead := (headName == ""); noHead {
-		return "", fmt.Errorf("unable to read %v", srcName)
+	return name, nil
+}
+
+// Restore the metadata stored in a header to an extracted file,
+//   i.e., its ownership (as root), xattrs, permissions, and timestamps.
+// A directory's permissions and timestamps are restored later
+//   by restoreDirs, so that extracting into it doesn't change them.
+// Warn about anything which can't be restored instead of failing.
+func (t *tarchive) restore(hdr *tar.Header, name string) {
+
+	// Change the ownership first, since it may clear setuid bits
+	//   and capabilities.
+	if isRoot := (os.Geteuid() == 0); isRoot && DoPreserve {
+		uid, gid := t.owner(hdr)
+		if err := os.Lchown(name, uid, gid); err != nil {
+			printWarning(hdr.Name, fmt.Errorf("cannot restore ownership: %v", err))
+		}
 	}
 
-	// Strip off the trailing '/'.
-	headName = headName[0 : len(headName)-1]
+	restoreXattrs(hdr, name)
 
-	return headName, nil
+	if hdr.Typeflag == tar.TypeDir {
+		t.dirs = append(t.dirs, extractedDir{hdr, name})
+		return
+	}
+
+	restoreModeAndTimes(hdr, name)
 }
 
-// Extract a tar archive.
-func (t *tarchive) untar(dstName string, headName string) error {
+// Restore the permissions and timestamps of every extracted directory,
+//   once whatever they were extracted into has been moved
+//   from `from` to `to`.
+// Deeper directories come later in an archive, so go in reverse order.
+func (t *tarchive) restoreDirs(from string, to string) {
+	for i := len(t.dirs) - 1; i >= 0; i-- {
+		name := t.dirs[i].name
+		if rel, err := filepath.Rel(from, name); err == nil {
+			name = filepath.Join(to, rel)
+		}
+		restoreModeAndTimes(t.dirs[i].hdr, name)
+	}
+	t.dirs = nil
+}
 
-	src := t.src
-	srcName := t.srcName
-	tr := t.reader
+// Restore the permissions and timestamps stored in a header
+//   to an extracted file.
+// Symlinks keep their own permissions, but get their own timestamps
+//   instead of those of their targets.
+func restoreModeAndTimes(hdr *tar.Header, name string) {
 
-	// Get file info.
-	srcInfo, err := src.Stat()
+	if !DoPreserve {
+		return
+	}
+
+	// Never follow a symlink, even one which replaced the file.
+	fi, err := os.Lstat(name)
 	if err != nil {
-		return err
+		printWarning(hdr.Name, fmt.Errorf("cannot restore permissions: %v", err))
+		return
 	}
-	srcSize := srcInfo.Size()
-	total := uint64(srcSize)
 
-	var progress uint64
-	var outputLength int
-	var start time.Time
+	if hdr.Typeflag != tar.TypeSymlink && fi.Mode()&os.ModeSymlink == 0 {
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(name, mode); err != nil {
+			printWarning(hdr.Name, fmt.Errorf("cannot restore permissions: %v", err))
+		}
+	}
 
-	if !DoQuiet {
-		print(concat(srcName, "  >  ", dstName))
-		defer print()
+	// Only some tar formats store the access time.
+	accessTime := hdr.AccessTime
+	if accessTime.IsZero() {
+		accessTime = hdr.ModTime
 	}
+	if err := lchtimes(name, accessTime, hdr.ModTime); err != nil {
+		printWarning(hdr.Name, fmt.Errorf("cannot restore timestamps: %v", err))
+	}
+}
 
-	// Extract the archive.
-	for {
-		var hdr *tar.Header
-		hdr, err = tr.Next()
+// Return the local uid and gid a header's owner should be restored as.
+// The user and group are looked up by name, like GNU tar does,
+//   unless --numeric-owner is given or the names are unknown here.
+func (t *tarchive) owner(hdr *tar.Header) (uid, gid int) {
 
-		// Break if the end of the tar archive has been reached.
-		if err != nil {
-			if err == io.EOF {
-				err = nil
+	uid, gid = hdr.Uid, hdr.Gid
+	if DoNumericOwner {
+		return
+	}
+
+	if t.uids == nil {
+		t.uids = make(map[string]int)
+		t.gids = make(map[string]int)
+	}
+
+	if hdr.Uname != "" {
+		id, ok := t.uids[hdr.Uname]
+		if !ok {
+			id = -1
+			if u, err := user.Lookup(hdr.Uname); err == nil {
+				if n, err := strconv.Atoi(u.Uid); err == nil {
+					id = n
+				}
 			}
-			break
+			t.uids[hdr.Uname] = id
 		}
+		if id >= 0 {
+			uid = id
+		}
+	}
 
-		// Make sure existing files are not overwritten.
-		name := hdr.Name
-		name = strings.Replace(name, headName, dstName, 1)
-		name = unusedPath(name)
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			// Extract a directory.
-			err = os.MkdirAll(name, os.FileMode(hdr.Mode))
-
-		case tar.TypeReg, tar.TypeRegA:
-			// Extract a regular file.
-			var w *os.File
-			w, err = create(name, os.FileMode(hdr.Mode))
-			if err != nil {
-				break
+	if hdr.Gname != "" {
+		id, ok := t.gids[hdr.Gname]
+		if !ok {
+			id = -1
+			if g, err := user.LookupGroup(hdr.Gname); err == nil {
+				if n, err := strconv.Atoi(g.Gid); err == nil {
+					id = n
+				}
 			}
-			_, err = io.Copy(w, tr)
-			w.Close()
+			t.gids[hdr.Gname] = id
+		}
+		if id >= 0 {
+			gid = id
+		}
+	}
 
-		case tar.TypeLink:
-			// Extract a hard link.
-			err = os.Link(hdr.Linkname, name)
+	return
+}
 
-		case tar.TypeSymlink:
-			// Extract a symlink.
-			err = os.Symlink(hdr.Linkname, name)
+// Return the path a tar entry named `name` should be extracted to
+//   under `dir`.
+// Refuse names which would escape `dir`, either directly,
+//   e.g., "/etc/passwd" or "../../.bashrc",
+//   or through a symlink extracted earlier from the same archive.
+func safePath(dir string, name string) (string, error) {
 
-		default:
-			// If the Typeflag is missing, the data is probably corrupt.
-			// Just skip to the next one anyway if this happens.
+	clean := filepath.Clean(filepath.FromSlash(name))
+	parentRef := concat("..", string(filepath.Separator))
+
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" ||
+		clean == ".." || strings.HasPrefix(clean, parentRef) {
+		return "", fmt.Errorf("refusing to extract %q: it is outside the destination", name)
+	}
+
+	// Make sure no directory on the way to the entry is a symlink.
+	parent := dir
+	for _, elem := range strings.Split(filepath.Dir(clean), string(filepath.Separator)) {
+		if elem == "." {
 			continue
 		}
+		parent = filepath.Join(parent, elem)
 
-		if err != nil {
+		fi, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
 			break
 		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q: it is under a symlink", name)
+		}
+	}
 
-		// Print progress.
-		if DoQuiet || hdr.Size == int64(0) {
-			continue
+	return filepath.Join(dir, clean), nil
+}
+
+// Move the contents of a fully extracted archive out of `tmpDir`.
+// If the archive has a single top-level file or directory, move just that.
+// Otherwise, move `tmpDir` itself to a directory named after the archive.
+// Make sure existing files are not overwritten.
+// Return the name of whatever was moved and the name it was moved to.
+func moveExtracted(srcName string, tmpDir string, roots []string) (string, string, error) {
+
+	from := tmpDir
+	var dstName string
+
+	if len(roots) == 1 {
+		from = filepath.Join(tmpDir, roots[0])
+		dstName = roots[0]
+	} else {
+		dstName = filepath.Base(srcName)
+		dstName = strings.TrimSuffix(dstName, ".sz")
+		dstName = strings.TrimSuffix(dstName, ".tar")
+	}
+	setDstName(&dstName)
+
+	to, err := moveUnused(from, dstName)
+	return from, to, err
+}
+
+// Print every header of a tar archive without extracting anything.
+func listTar(srcName string, r io.Reader) error {
+
+	t := &tarchive{}
+	t.open(srcName, r)
+	defer t.close()
+
+	tr := t.reader
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
-		progress = progress + uint64(hdr.Size)
-		percent := int(float64(progress) / float64(total) * float64(100))
 
-		// Make sure progress isn't outputted more quickly
-		//   than the console can print.
-		if int(time.Since(start)) < 100000 && percent < 99 {
+		if DoJSON {
+			line, err := headerJSON(srcName, hdr)
+			if err != nil {
+				return err
+			}
+			report(line)
 			continue
 		}
-		start = time.Now()
 
-		output := fmt.Sprintf(
-			"  %v%%   %v / %v",
-			percent, sizeLabel(progress), sizeLabel(total),
-		)
-		// Clear previous output.
-		if len(output) > outputLength {
-			outputLength = len(output)
-		}
-		fmt.Printf("\r%v", strings.Repeat(" ", outputLength))
-		// Print new output.
-		fmt.Printf("\r%v", output)
+		report(headerLine(hdr))
 	}
+}
 
-	if err != nil {
-		return err
-	}
+// Read every header and file of a tar archive without extracting anything.
+func verifyTar(r io.Reader) error {
 
-	return nil
+	tr := tar.NewReader(r)
+
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
 }
 
-func (t *tarchive) close() {
+// Finish writing or reading an archive.
+// Safe to call more than once.
+func (t *tarchive) close() error {
 
-	if t.dst != nil {
-		t.dst.Close()
-		t.writer.Close()
+	var err error
+
+	if t.writer != nil {
+		err = t.writer.Close()
+		if szErr := t.sz.Close(); err == nil {
+			err = szErr
+		}
+		t.writer = nil
+		t.sz = nil
+		t.raw = nil
 		t.hardlinks = nil
 	}
 
-	if t.src != nil {
-		t.src.Close()
-		t.reader = nil
-	}
+	t.reader = nil
+	t.dirs = nil
+
+	return err
 }
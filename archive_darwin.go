@@ -1,7 +1,71 @@
 package main
 
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
 // https://github.com/docker/docker/blob/master/pkg/system/xattrs_linux.go
 // This only works for linux.
 func lgetxattr(path string, attr string) ([]byte, error) {
 	return nil, nil
 }
+
+// This only works for linux.
+// List the names of every xattr of a file.
+func llistxattr(path string) ([]string, error) {
+	return nil, nil
+}
+
+// This only works for linux.
+// Set an xattr of a file.
+func lsetxattr(path string, attr string, value []byte) error {
+	return nil
+}
+
+// Set the access and modification times of a file.
+// The times of a symlink itself can't be set here,
+//   so leave symlinks alone rather than change their targets.
+func lchtimes(name string, atime time.Time, mtime time.Time) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Whence values for Seek which find the next data or hole in a file.
+const (
+	seekHoleWhence = 3
+	seekDataWhence = 4
+)
+
+// Return the device major number of system data from syscall.Stat_t.Rdev.
+// Darwin uses a 32-bit dev_t: 8 bits of major and 24 of minor.
+func devmajor(device uint64) uint64 {
+	return (device >> 24) & 0xff
+}
+
+// Return the device minor number of system data from syscall.Stat_t.Rdev.
+func devminor(device uint64) uint64 {
+	return device & 0xffffff
+}
+
+// Return the dev_t of a device from its major and minor numbers.
+func makedev(major uint64, minor uint64) uint64 {
+	return (major&0xff)<<24 | minor&0xffffff
+}
+
+// Return the last access time of a file,
+//   or its modification time if the access time is unavailable.
+func atime(fi os.FileInfo) time.Time {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(s.Atimespec.Sec), int64(s.Atimespec.Nsec))
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"os"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 // https://github.com/docker/docker/blob/master/pkg/system/xattrs_linux.go
 // Get the underlying data for an xattr of a file.
 // Return a nil slice and nil error if the xattr is not set.
-// Other than that, I have no idea how this function works.
+// Symlinks are not followed.
 func lgetxattr(path string, attr string) ([]byte, error) {
 	pathBytes, err := syscall.BytePtrFromString(path)
 	if err != nil {
@@ -19,24 +22,12 @@ func lgetxattr(path string, attr string) ([]byte, error) {
 		return nil, err
 	}
 
-	dest := make([]byte, 128)
-	destBytes := unsafe.Pointer(&dest[0])
-	sz, _, errno := syscall.Syscall6(
-		syscall.SYS_LGETXATTR,
-		uintptr(unsafe.Pointer(pathBytes)),
-		uintptr(unsafe.Pointer(attrBytes)),
-		uintptr(destBytes),
-		uintptr(len(dest)),
-		0,
-		0,
-	)
-	if errno == syscall.ENODATA {
-		return nil, nil
-	}
-	if errno == syscall.ERANGE {
-		dest = make([]byte, sz)
-		destBytes := unsafe.Pointer(&dest[0])
-		sz, _, errno = syscall.Syscall6(
+	get := func(dest []byte) (int, error) {
+		var destBytes unsafe.Pointer
+		if len(dest) > 0 {
+			destBytes = unsafe.Pointer(&dest[0])
+		}
+		sz, _, errno := syscall.Syscall6(
 			syscall.SYS_LGETXATTR,
 			uintptr(unsafe.Pointer(pathBytes)),
 			uintptr(unsafe.Pointer(attrBytes)),
@@ -45,10 +36,181 @@ func lgetxattr(path string, attr string) ([]byte, error) {
 			0,
 			0,
 		)
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(sz), nil
+	}
+
+	return xattrRetry(get)
+}
+
+// List the names of every xattr of a file.
+// Return a nil slice and nil error if the filesystem
+//   does not support xattrs.
+// Symlinks are not followed.
+func llistxattr(path string) ([]string, error) {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	list := func(dest []byte) (int, error) {
+		var destBytes unsafe.Pointer
+		if len(dest) > 0 {
+			destBytes = unsafe.Pointer(&dest[0])
+		}
+		sz, _, errno := syscall.Syscall(
+			syscall.SYS_LLISTXATTR,
+			uintptr(unsafe.Pointer(pathBytes)),
+			uintptr(destBytes),
+			uintptr(len(dest)),
+		)
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(sz), nil
+	}
+
+	names, err := xattrRetry(list)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	// The names are separated, and ended, by NUL bytes.
+	return strings.Split(strings.TrimSuffix(string(names), "\x00"), "\x00"), nil
+}
+
+// Read an xattr value or list with `get`,
+//   which fills a buffer and returns the length of its contents.
+// Given an empty buffer, `get` returns the length needed.
+// Retry if the value grows between asking for its length and reading it.
+func xattrRetry(get func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		sz, err := get(nil)
+		if err == syscall.ENODATA || err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+
+		dest := make([]byte, sz)
+		sz, err = get(dest)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err == syscall.ENODATA {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return dest[:sz], nil
+	}
+}
+
+// Set an xattr of a file.
+// Symlinks are not followed.
+func lsetxattr(path string, attr string, value []byte) error {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrBytes, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+
+	var valueBytes unsafe.Pointer
+	if len(value) > 0 {
+		valueBytes = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(pathBytes)),
+		uintptr(unsafe.Pointer(attrBytes)),
+		uintptr(valueBytes),
+		uintptr(len(value)),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Whence values for Seek which find the next data or hole in a file.
+const (
+	seekDataWhence = 3
+	seekHoleWhence = 4
+)
+
+// Copies of linux's AT_FDCWD and AT_SYMLINK_NOFOLLOW,
+//   which the syscall package doesn't define on every architecture.
+const (
+	atFdcwd           = -0x64
+	atSymlinkNofollow = 0x100
+)
+
+// Set the access and modification times of a file.
+// Unlike os.Chtimes, symlinks are not followed.
+func lchtimes(name string, atime time.Time, mtime time.Time) error {
+	nameBytes, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
 	}
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_UTIMENSAT,
+		uintptr(dirfd),
+		uintptr(unsafe.Pointer(nameBytes)),
+		uintptr(unsafe.Pointer(&ts[0])),
+		atSymlinkNofollow,
+		0,
+		0,
+	)
 	if errno != 0 {
-		return nil, errno
+		return &os.PathError{Op: "lchtimes", Path: name, Err: errno}
 	}
 
-	return dest[:sz], nil
+	return nil
+}
+
+// https://github.com/docker/docker/blob/master/pkg/archive/archive_unix.go
+// Return the device major number of system data from syscall.Stat_t.Rdev.
+// Like glibc's major(), use the 64-bit encoding of dev_t,
+//   which reduces to the old 16-bit one for small numbers.
+func devmajor(device uint64) uint64 {
+	return (device>>8)&0xfff | (device>>32)&0xfffff000
+}
+
+// https://github.com/docker/docker/blob/master/pkg/archive/archive_unix.go
+// Return the device minor number of system data from syscall.Stat_t.Rdev.
+func devminor(device uint64) uint64 {
+	return device&0xff | (device>>12)&0xffffff00
+}
+
+// Return the dev_t of a device from its major and minor numbers,
+//   like glibc's makedev().
+func makedev(major uint64, minor uint64) uint64 {
+	return minor&0xff | (major&0xfff)<<8 | (minor&0xffffff00)<<12 | (major&0xfffff000)<<32
+}
+
+// Return the last access time of a file,
+//   or its modification time if the access time is unavailable.
+func atime(fi os.FileInfo) time.Time {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(s.Atim.Sec), int64(s.Atim.Nsec))
 }
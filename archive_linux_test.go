@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestMakedev tests that device numbers survive a round trip through dev_t,
+//   including ones too large for the old 16-bit encoding.
+func TestMakedev(t *testing.T) {
+
+	devices := [][2]uint64{
+		{1, 3},
+		{8, 0},
+		{259, 65536},
+		{0xfffff, 0xfffff},
+		{0xffffffff, 0xffffffff},
+	}
+
+	for _, d := range devices {
+		dev := makedev(d[0], d[1])
+		if major, minor := devmajor(dev), devminor(dev); major != d[0] || minor != d[1] {
+			t.Errorf("Expected %v,%v but got %v,%v.\n", d[0], d[1], major, minor)
+		}
+	}
+
+	// The old encoding must still hold for small numbers.
+	if dev := makedev(8, 1); dev != 0x801 {
+		t.Errorf("Expected 8,1 to be 0x801 but got %#x.\n", dev)
+	}
+}
+
+// TestUntarSpecial tests that FIFOs are extracted
+//   and that entries of unknown types are skipped.
+func TestUntarSpecial(t *testing.T) {
+
+	entries := []tarEntry{
+		{name: "top/", typeflag: tar.TypeDir},
+		{name: "top/fifo", typeflag: tar.TypeFifo, mode: 0600},
+		// A GNU volume header.
+		{name: "top/volume", typeflag: 'V'},
+		{name: "top/file", typeflag: tar.TypeReg, contents: "x"},
+	}
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	DstDir = root
+	defer func() { DstDir = "" }()
+
+	dstName, err := untar("top.tar", buildTar(t, entries), &bombGuard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dstName, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != os.ModeNamedPipe|0600 {
+		t.Errorf("Expected a FIFO with mode 0600 but got %v.\n", fi.Mode())
+	}
+
+	if exists(filepath.Join(dstName, "volume")) {
+		t.Errorf("Expected the volume header to be skipped.\n")
+	}
+	if !exists(filepath.Join(dstName, "file")) {
+		t.Errorf("Expected the file after the volume header to be extracted.\n")
+	}
+}
+
+// TestSparse tests that a file with holes is archived without them,
+//   can be read back by the tar reader,
+//   and is extracted with holes given --sparse.
+func TestSparse(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A file which is mostly holes.
+	src := filepath.Join(root, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(src, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var archive bytes.Buffer
+	if err := tarDir(&archive, src, "src.tar.sz", nil); err != nil {
+		t.Fatal(err)
+	}
+	if archive.Len() > 64<<10 {
+		t.Errorf("Expected the holes to be left out but the archive is %v bytes.\n", archive.Len())
+	}
+
+	DstDir = filepath.Join(root, "dst")
+	DoSparse = true
+	defer func() { DstDir, DoSparse = "", false }()
+	if err := os.Mkdir(DstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	szr := newParallelReader(&archive, 0)
+	defer szr.Close()
+	dstName, err := untar("src.tar.sz", szr, &bombGuard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dstName, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected[size/2:], "middle")
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("Expected the extracted file to match the original.\n")
+	}
+
+	fi, err := os.Stat(filepath.Join(dstName, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := fi.Sys().(*syscall.Stat_t).Blocks; blocks*512 >= size/2 {
+		t.Errorf("Expected the extracted file to have holes but it uses %v blocks.\n", blocks)
+	}
+}
+
+// TestVerifySparse tests that --verify accepts a directory with a file
+//   with holes, both when it is archived and when it is extracted.
+func TestVerifySparse(t *testing.T) {
+
+	DoVerify, DoSparse = true, true
+	defer func() { DoVerify, DoSparse = false, false }()
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := filepath.Join(root, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const size = 10 << 20
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	DstDir = filepath.Join(root, "dst")
+	defer func() { DstDir = "" }()
+	if err := os.Mkdir(DstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	szName, err := compressOrDecompress(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstName, err := compressOrDecompress(szName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dstName, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Errorf("Expected the extracted file to be %v bytes but got %v.\n", size, fi.Size())
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// tarEntry describes one entry of a tar archive built for a test.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	contents string
+	mode     int64
+	modTime  time.Time
+}
+
+// Build a tar archive in memory.
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.mode != 0 {
+			hdr.Mode = e.mode
+		}
+		hdr.ModTime = e.modTime
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &b
+}
+
+// TestUntarUnsafe tests that entries which would escape the destination
+//   are refused and that nothing is left behind.
+func TestUntarUnsafe(t *testing.T) {
+
+	archives := map[string][]tarEntry{
+		"parent": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/../../escaped", typeflag: tar.TypeReg, contents: "x"},
+		},
+		"absolute": {
+			{name: "/tmp/escaped", typeflag: tar.TypeReg, contents: "x"},
+		},
+		"hardlink": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/link", typeflag: tar.TypeLink, linkname: "../outside/secret"},
+		},
+		"symlink": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "top/link/escaped", typeflag: tar.TypeReg, contents: "x"},
+		},
+		"symlink dir": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/link", typeflag: tar.TypeSymlink, linkname: "../../../outside"},
+			{name: "top/link/", typeflag: tar.TypeDir, mode: 0777},
+		},
+	}
+
+	for name, entries := range archives {
+		t.Run(name, func(t *testing.T) {
+
+			root, err := ioutil.TempDir("", "snapzip-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			DstDir = filepath.Join(root, "dst")
+			defer func() { DstDir = "" }()
+			if err := os.Mkdir(DstDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = untar(name, buildTar(t, entries), &bombGuard{})
+			if err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("Expected a refusal but got %v.\n", err)
+				return
+			}
+
+			if exists(filepath.Join(root, "escaped")) || exists(filepath.Join(outside, "escaped")) {
+				t.Errorf("Expected nothing to be written outside of %v.\n", DstDir)
+			}
+			if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() != 0755 {
+				t.Errorf("Expected %v to keep its permissions.\n", outside)
+			}
+
+			left, err := ioutil.ReadDir(DstDir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(left) != 0 {
+				t.Errorf("Expected %v to be empty but found %v.\n", DstDir, left[0].Name())
+			}
+		})
+	}
+}
+
+// TestUntarFailure tests that a tar archive which ends partway through
+//   leaves neither a temporary directory nor a partial one behind.
+func TestUntarFailure(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	DstDir = root
+	defer func() { DstDir = "" }()
+
+	tarball := buildTar(t, []tarEntry{
+		{name: "top/", typeflag: tar.TypeDir},
+		{name: "top/a", typeflag: tar.TypeReg, contents: "a"},
+		{name: "top/b", typeflag: tar.TypeReg, contents: strings.Repeat("b", 4096)},
+	}).Bytes()
+
+	// Cut the archive off in the middle of the last file.
+	truncated := bytes.NewReader(tarball[:5*512+100])
+	if _, err := untar("top.tar", truncated, &bombGuard{}); err == nil {
+		t.Fatal("Expected extraction to fail.")
+	}
+
+	left, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("Expected %v to be empty but found %v.\n", root, left[0].Name())
+	}
+}
+
+// TestUntarRestore tests that permissions and timestamps are restored,
+//   even for read-only directories, directories extracted into,
+//   and symlinks.
+func TestUntarRestore(t *testing.T) {
+
+	dirTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	fileTime := time.Date(2002, 2, 2, 0, 0, 0, 0, time.UTC)
+	linkTime := time.Date(2003, 3, 3, 0, 0, 0, 0, time.UTC)
+
+	entries := []tarEntry{
+		{name: "top/", typeflag: tar.TypeDir, modTime: dirTime},
+		{name: "top/ro/", typeflag: tar.TypeDir, mode: 0555, modTime: dirTime},
+		{name: "top/ro/file", typeflag: tar.TypeReg, contents: "x", mode: 0600, modTime: fileTime},
+		{name: "top/link", typeflag: tar.TypeSymlink, linkname: "ro/file", modTime: linkTime},
+	}
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer os.Chmod(filepath.Join(root, "top", "ro"), 0755)
+
+	DstDir = root
+	defer func() { DstDir = "" }()
+
+	dstName, err := untar("top.tar", buildTar(t, entries), &bombGuard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name    string
+		mode    os.FileMode
+		modTime time.Time
+	}{
+		{"", os.ModeDir | 0755, dirTime},
+		{"ro", os.ModeDir | 0555, dirTime},
+		{"ro/file", 0600, fileTime},
+		{"link", os.ModeSymlink | 0777, linkTime},
+	}
+
+	for _, e := range expected {
+		fi, err := os.Lstat(filepath.Join(dstName, e.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if e.mode&os.ModeSymlink == 0 && fi.Mode() != e.mode {
+			t.Errorf("Expected %v to have mode %v but got %v.\n", e.name, e.mode, fi.Mode())
+		}
+		if !fi.ModTime().Equal(e.modTime) {
+			t.Errorf("Expected %v to have mtime %v but got %v.\n", e.name, e.modTime, fi.ModTime())
+		}
+	}
+}
+
+// TestUntarReadOnlyTop tests that an archive whose top directory
+//   is read-only is moved into place before its mode is restored,
+//   and that nothing else is left behind.
+func TestUntarReadOnlyTop(t *testing.T) {
+
+	dirTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []tarEntry{
+		{name: "ro/", typeflag: tar.TypeDir, mode: 0555, modTime: dirTime},
+		{name: "ro/file", typeflag: tar.TypeReg, contents: "x", mode: 0644},
+	}
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer os.Chmod(filepath.Join(root, "ro"), 0755)
+
+	DstDir = root
+	defer func() { DstDir = "" }()
+
+	dstName, err := untar("ro.tar", buildTar(t, entries), &bombGuard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != os.ModeDir|0555 || !fi.ModTime().Equal(dirTime) {
+		t.Errorf("Expected %v to have mode %v and mtime %v but got %v and %v.\n",
+			dstName, os.ModeDir|0555, dirTime, fi.Mode(), fi.ModTime())
+	}
+
+	left, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 {
+		t.Errorf("Expected only %v in %v but found %v files.\n", dstName, root, len(left))
+	}
+}
+
+// TestXattrIncluded tests --xattrs-include and --xattrs-exclude patterns.
+func TestXattrIncluded(t *testing.T) {
+
+	defer func() { XattrsInclude, XattrsExclude = nil, nil }()
+
+	tests := []struct {
+		include  []string
+		exclude  []string
+		attr     string
+		expected bool
+	}{
+		{nil, nil, "security.capability", true},
+		{[]string{"user"}, nil, "user.comment", true},
+		{[]string{"user"}, nil, "username.comment", false},
+		{[]string{"system.posix_acl_*"}, nil, "system.posix_acl_access", true},
+		{[]string{"system.posix_acl_*"}, nil, "security.selinux", false},
+		{nil, []string{"security.selinux"}, "security.selinux", false},
+		{nil, []string{"security.selinux"}, "security.capability", true},
+		{[]string{"user"}, []string{"user.secret"}, "user.secret", false},
+	}
+
+	for _, test := range tests {
+		XattrsInclude, XattrsExclude = test.include, test.exclude
+		if included := xattrIncluded(test.attr); included != test.expected {
+			t.Errorf("Expected %v to be included: %v, but got %v (include %v, exclude %v).\n",
+				test.attr, test.expected, included, test.include, test.exclude)
+		}
+	}
+}
+
+// TestTarFiles tests bundling files and directories into one archive.
+func TestTarFiles(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, dir := range []string{"bin", "conf"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"bin/app", "conf/app.yaml", "README"} {
+		if err := ioutil.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := tarFiles(&archive, []string{"bin/", "conf/app.yaml", "./README"}, "release.tar.sz", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	szr := newParallelReader(&archive, 0)
+	defer szr.Close()
+	tr := tar.NewReader(szr)
+
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{"bin/", "bin/app", "conf/app.yaml", "README"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v but got %v.\n", expected, names)
+	}
+}
+
+// TestMemberName tests the names given files have in an archive.
+func TestMemberName(t *testing.T) {
+
+	names := map[string]string{
+		"README":     "README",
+		"bin/":       "bin",
+		"./conf//a":  "conf/a",
+		"/etc/hosts": "etc/hosts",
+		"../../x":    "x",
+		"a/../../y":  "y",
+		"..":         ".",
+		"/":          ".",
+	}
+
+	for srcName, expected := range names {
+		if name := memberName(srcName); name != expected {
+			t.Errorf("Expected %q to be named %q but got %q.\n", srcName, expected, name)
+		}
+	}
+}
+
+// Generate a tree of files for benchmarks:
+//   source-like text files of varying sizes and a few larger ones.
+func benchmarkTree(b *testing.B) string {
+
+	root, err := ioutil.TempDir("", "snapzip-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields("func return if err != nil { } package import type struct for range := string int byte")
+
+	for d := 0; d < 20; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%02d", d))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for f := 0; f < 50; f++ {
+			var contents bytes.Buffer
+			for n := rng.Intn(1 << 15); contents.Len() < n; {
+				contents.WriteString(words[rng.Intn(len(words))])
+				if rng.Intn(8) == 0 {
+					contents.WriteString(fmt.Sprintf(" %x\n", rng.Int63()))
+				} else {
+					contents.WriteByte(' ')
+				}
+			}
+			name := filepath.Join(dir, fmt.Sprintf("file%02d.go", f))
+			if err := ioutil.WriteFile(name, contents.Bytes(), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(root, fmt.Sprintf("blob%v", i))
+		if err := ioutil.WriteFile(name, framingTestData(1<<20), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// Write a plain tar archive of a tree to `w`.
+func tarTree(b *testing.B, w io.Writer, root string) {
+
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		if hdr.Name, err = filepath.Rel(root, path); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkTarRatio compares the size of a compressed tar archive
+//   written in two passes, i.e., tarred to a file and then compressed,
+//   with one written in a single pass, both as tarDir does, buffering
+//   whole blocks, and straight into an unbuffered *snappy.Writer.
+// Run it with -bench TarRatio and compare the compressed-bytes metrics.
+func BenchmarkTarRatio(b *testing.B) {
+
+	defer func(quiet bool) { DoQuiet = quiet }(DoQuiet)
+	DoQuiet = true
+
+	root := benchmarkTree(b)
+	defer os.RemoveAll(root)
+
+	var plain bytes.Buffer
+	tarTree(b, &plain, root)
+
+	ways := []struct {
+		name string
+		snap func(w io.Writer)
+	}{
+		{"two-pass", func(w io.Writer) {
+			var tarred bytes.Buffer
+			tarTree(b, &tarred, root)
+			if _, err := snap(w, &tarred, nil); err != nil {
+				b.Fatal(err)
+			}
+		}},
+		{"single-pass", func(w io.Writer) {
+			if err := tarDir(w, root, "tree.tar.sz", nil); err != nil {
+				b.Fatal(err)
+			}
+		}},
+		{"single-pass-unbuffered", func(w io.Writer) {
+			tarTree(b, snappy.NewWriter(w), root)
+		}},
+	}
+
+	for _, way := range ways {
+		b.Run(way.name, func(b *testing.B) {
+			var snapped bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				snapped.Reset()
+				way.snap(&snapped)
+			}
+			b.SetBytes(int64(plain.Len()))
+			b.ReportMetric(float64(snapped.Len()), "compressed-bytes")
+			b.ReportMetric(float64(snapped.Len())/float64(plain.Len()), "ratio")
+		})
+	}
+}
@@ -5,6 +5,8 @@ package main
 import (
 	"archive/tar"
 	"fmt"
+	"io"
+	"os"
 	"syscall"
 )
 
@@ -23,7 +25,7 @@ func tarSetHeader(hdr *tar.Header, stat interface{}) (hasHardlinks bool, inode u
 	inode = uint64(s.Ino)
 
 	// Currently go does not fill in the major/minors
-	if s.Mode&syscall.S_IFBLK != 0 || s.Mode&syscall.S_IFCHR != 0 {
+	if fileType := s.Mode & syscall.S_IFMT; fileType == syscall.S_IFBLK || fileType == syscall.S_IFCHR {
 		hdr.Devmajor = int64(devmajor(uint64(s.Rdev)))
 		hdr.Devminor = int64(devminor(uint64(s.Rdev)))
 	}
@@ -31,14 +33,111 @@ func tarSetHeader(hdr *tar.Header, stat interface{}) (hasHardlinks bool, inode u
 	return
 }
 
-// https://github.com/docker/docker/blob/master/pkg/archive/archive_unix.go
-// Return the device major number of system data from syscall.Stat_t.Rdev.
-func devmajor(device uint64) uint64 {
-	return (device >> 8) & 0xfff
+// Return the uid and gid of a file's owner.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return int(s.Uid), int(s.Gid), true
 }
 
-// https://github.com/docker/docker/blob/master/pkg/archive/archive_unix.go
-// Return the device minor number of system data from syscall.Stat_t.Rdev.
-func devminor(device uint64) uint64 {
-	return (device & 0xff) | ((device >> 12) & 0xfff00)
+// Create a device node or FIFO for a tar entry.
+// Its permissions are restored afterward, along with its other metadata.
+func mknod(name string, hdr *tar.Header) error {
+
+	mode := uint32(hdr.Mode & 07777)
+
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		return syscall.Mkfifo(name, mode)
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	}
+
+	dev := makedev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
+	return syscall.Mknod(name, mode, int(dev))
+}
+
+// Return the regions of a file which hold data,
+//   or nil if the file has no holes.
+// The file is left at its start.
+func sparseData(file *os.File, size int64) ([]sparseEntry, error) {
+
+	data, err := seekData(file, size)
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Treat a file as having no holes if the filesystem can't find them.
+	if err != nil {
+		return nil, nil
+	}
+	if len(data) == 1 && data[0].offset == 0 && data[0].length == size {
+		return nil, nil
+	}
+
+	// Mark the end of a file which ends with a hole, like GNU tar does.
+	if len(data) == 0 || data[len(data)-1].offset+data[len(data)-1].length < size {
+		data = append(data, sparseEntry{size, 0})
+	}
+
+	return data, nil
+}
+
+// Find the regions of a file which hold data with SEEK_DATA and SEEK_HOLE.
+func seekData(file *os.File, size int64) ([]sparseEntry, error) {
+
+	var data []sparseEntry
+
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, seekDataWhence)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			// Only a hole is left.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := file.Seek(start, seekHoleWhence)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+
+		data = append(data, sparseEntry{start, end - start})
+		offset = end
+	}
+
+	return data, nil
+}
+
+// Flush a directory's entries to disk, e.g., after a file is moved into it.
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Check whether a hard link failed because the filesystem
+//   doesn't support them, or not across the directories given.
+func linkUnsupported(err error) bool {
+	le, ok := err.(*os.LinkError)
+	if !ok {
+		return false
+	}
+	switch le.Err {
+	case syscall.EPERM, syscall.ENOTSUP, syscall.EXDEV, syscall.EMLINK, syscall.ENOSYS:
+		return true
+	}
+	return false
 }
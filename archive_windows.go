@@ -1,6 +1,12 @@
 package main
 
-import "archive/tar"
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
 
 // https://github.com/docker/docker/blob/master/pkg/archive/archive_unix.go
 // Windows does not use anything like this on its filesystem.
@@ -19,3 +25,84 @@ func tarSetHeader(hdr *tar.Header, stat interface{}) (hasHardlinks bool, inode u
 func lgetxattr(path string, attr string) ([]byte, error) {
 	return nil, nil
 }
+
+// This only works for linux.
+// List the names of every xattr of a file.
+func llistxattr(path string) ([]string, error) {
+	return nil, nil
+}
+
+// This only works for linux.
+// Set an xattr of a file.
+func lsetxattr(path string, attr string, value []byte) error {
+	return nil
+}
+
+// Set the access and modification times of a file.
+// The times of a symlink itself can't be set here,
+//   so leave symlinks alone rather than change their targets.
+func lchtimes(name string, atime time.Time, mtime time.Time) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Windows has no device nodes or FIFOs.
+// Create a device node or FIFO for a tar entry.
+func mknod(name string, hdr *tar.Header) error {
+	return fmt.Errorf("not supported on windows")
+}
+
+// Windows can't find the holes in a file.
+// Return the regions of a file which hold data,
+//   or nil if the file has no holes.
+func sparseData(file *os.File, size int64) ([]sparseEntry, error) {
+	return nil, nil
+}
+
+// Return the last access time of a file,
+//   or its modification time if the access time is unavailable.
+func atime(fi os.FileInfo) time.Time {
+	d, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(0, d.LastAccessTime.Nanoseconds())
+}
+
+// Windows does not use anything like Unix ownership.
+// Return the uid and gid of a file's owner.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return
+}
+
+// Windows can't open directories to flush them.
+// Flush a directory's entries to disk, e.g., after a file is moved into it.
+func syncDir(name string) error {
+	return nil
+}
+
+// Windows errors for a hard link on a filesystem without them, e.g., FAT.
+const (
+	errorInvalidFunction = syscall.Errno(1)
+	errorNotSupported    = syscall.Errno(50)
+)
+
+// Check whether a hard link failed because the filesystem
+//   doesn't support them.
+func linkUnsupported(err error) bool {
+	le, ok := err.(*os.LinkError)
+	if !ok {
+		return false
+	}
+	switch le.Err {
+	case errorInvalidFunction, errorNotSupported, syscall.ERROR_ACCESS_DENIED:
+		return true
+	}
+	return false
+}
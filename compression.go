@@ -1,35 +1,35 @@
 package main
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
 	"strings"
-
-	"github.com/golang/snappy"
 )
 
 // Compress a file to a snappy archive.
-func snap(src *os.File) (string, error) {
+// `r` reads the contents of `src`, and `srcInfo` describes it.
+func snapFile(src *os.File, srcInfo os.FileInfo, r io.Reader) (string, error) {
 
-	// Get file info.
-	srcInfo, err := src.Stat()
-	if err != nil {
-		return "", err
-	}
 	srcName := src.Name()
 
-	// Make sure existing files are not overwritten.
 	dstName := concat(srcName, ".sz")
-	setDstName(&dstName)
-
-	print(concat(srcName, "  >  ", dstName))
+	if err := setTreeDstName(srcName, &dstName); err != nil {
+		return "", err
+	}
 
-	// Create the destination file.
-	dst, err := create(dstName, srcInfo.Mode())
+	// Create the destination file under a temporary name.
+	dst, err := createPending(dstName, srcInfo.Mode())
 	if err != nil {
 		return "", err
 	}
-	defer dst.Close()
+	defer dst.abort()
+
+	print(concat(srcName, "  >  ", dstName))
 
 	// Set up a *passthru writer in order to print progress.
 	pt := &passthru{
@@ -38,30 +38,79 @@ func snap(src *os.File) (string, error) {
 	}
 	defer pt.Reset()
 
-	// Wrap a *snappy.Writer around the *passthru method.
-	sz := snappy.NewWriter(pt)
-	defer sz.Reset(nil)
+	// With --verify, hash the contents to check the new file against.
+	h := newVerifyHash()
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
 
-	// Write the source file's contents to the new snappy file.
-	_, err = snapCopy(sz, src)
+	// Write the source file's contents to the new snappy file,
+	//   along with its name and other metadata.
+	_, err = snap(pt, r, newFileMetadata(src, srcInfo))
 	print()
 	if err != nil {
 		return "", err
 	}
 
-	return dstName, nil
+	// Close the file before copying metadata to it,
+	//   so that no later write changes its timestamps.
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	if err := verifyOutput(dst.Name(), h, true); err != nil {
+		return "", err
+	}
+	if err := preserve(dst.Name(), srcInfo); err != nil {
+		return "", err
+	}
+
+	// Move the finished file into place.
+	// Make sure existing files are not overwritten.
+	return dst.commit()
+}
+
+// Compress data from a reader and write it to a writer as a snappy stream.
+// Blocks are compressed on every CPU at once.
+// If `metadata` is not nil, store it in the stream,
+//   followed by a digest of the data if it asks for one.
+func snap(dst io.Writer, src io.Reader, metadata *fileMetadata) (int64, error) {
+
+	sz := newParallelWriter(dst, runtime.GOMAXPROCS(0))
+	sz.indexed = DoSeekable
+
+	var digest hash.Hash
+	if metadata != nil {
+		sz.writeChunk(encodeMetadata(metadata))
+		if metadata.hasDigest {
+			digest = sha256.New()
+			src = io.TeeReader(src, digest)
+		}
+	}
+
+	nWritten, err := snapCopy(sz, src)
+	if err == nil && metadata != nil {
+		if uint64(nWritten) != metadata.size {
+			err = fmt.Errorf("file changed size as it was read")
+		} else if digest != nil {
+			sz.writeChunk(encodeDigest(digest.Sum(nil)))
+		}
+	}
+	if closeErr := sz.Close(); err == nil {
+		err = closeErr
+	}
+
+	return nWritten, err
 }
 
 // SnappyMaxUncompressedChunkLen is a copy of snappy.maxUncompressedChunkLen
 const SnappyMaxUncompressedChunkLen = 65536
 
-// Read data from a source file,
+// Read data from a source reader,
 //   compress the data,
-//   and write it to a *snappy.Writer destination file.
+//   and write it to a snappy writer destination.
 // Serves as a makeshift snappy replacement for io.Copy
-//   as long as the source Reader is an *os.File
-//   and the destination Writer is a *snappy.Writer.
-func snapCopy(sz *snappy.Writer, src *os.File) (int64, error) {
+//   which writes whole blocks at a time.
+func snapCopy(sz io.Writer, src io.Reader) (int64, error) {
 
 	buf := make([]byte, SnappyMaxUncompressedChunkLen)
 	return io.CopyBuffer(sz, src, buf)
@@ -75,42 +124,98 @@ func snapCopy(sz *snappy.Writer, src *os.File) (int64, error) {
 	// return int64(totalWritten), err
 }
 
-// Decompress a snappy archive.
-func unsnap(src *os.File) (string, error) {
+// Write the uncompressed contents of a snappy archive to a new file.
+// `unsnapped` reads the uncompressed contents of the archive
+//   `srcPath`, which `srcInfo` describes.
+// With -N, name the file after the original file,
+//   and give it the original file's permissions and timestamps,
+//   if `metadata` describes the original file.
+func unsnapFile(srcPath string, srcInfo os.FileInfo, metadata *fileMetadata, unsnapped io.Reader) (string, error) {
 
-	srcInfo, err := src.Stat()
-	if err != nil {
-		return "", err
-	}
 	srcName := srcInfo.Name()
 
-	// Make sure existing files are not overwritten.
 	dstName := strings.TrimSuffix(srcName, ".sz")
-	setDstName(&dstName)
+	if DoName && metadata != nil {
+		if name := metadata.fileName(); name != "" {
+			dstName = name
+			srcInfo = metadataInfo{srcInfo, metadata}
+		}
+	}
+	if err := setTreeDstName(srcPath, &dstName); err != nil {
+		return "", err
+	}
+
+	// Create the destination file under a temporary name.
+	dst, err := createPending(dstName, srcInfo.Mode())
+	if err != nil {
+		return "", err
+	}
+	defer dst.abort()
 
 	print(concat(srcName, "  >  ", dstName))
 
-	// Create the destination file.
-	dst, err := create(dstName, srcInfo.Mode())
+	// With --verify, hash the contents to check the new file against.
+	h := newVerifyHash()
+	if h != nil {
+		unsnapped = io.TeeReader(unsnapped, h)
+	}
+
+	// With --sparse, leave holes for blocks of zeros.
+	w, finish := contentWriter(dst.File)
+	_, err = io.Copy(w, unsnapped)
 	if err != nil {
 		return "", err
 	}
-	defer dst.Close()
+	if err := finish(); err != nil {
+		return "", err
+	}
 
-	pt := &passthru{
-		Reader:    src,
-		nExpected: uint64(srcInfo.Size()),
+	// Close the file before copying metadata to it,
+	//   so that no later write changes its timestamps.
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	if err := verifyOutput(dst.Name(), h, false); err != nil {
+		return "", err
+	}
+	if err := preserve(dst.Name(), srcInfo); err != nil {
+		return "", err
 	}
-	defer pt.Reset()
 
-	szr := snappy.NewReader(pt)
-	defer szr.Reset(nil)
+	// Move the finished file into place.
+	// Make sure existing files are not overwritten.
+	return dst.commit()
+}
 
-	defer print()
-	_, err = io.Copy(dst, szr)
-	if err != nil {
-		return "", err
+// Decompress a snappy stream from a reader and write it to a writer.
+// Chunks are decoded on every CPU at once.
+// Stop once the stream passes any limit set by the user.
+func unsnap(dst io.Writer, src io.Reader) (int64, error) {
+
+	guard := &bombGuard{}
+
+	szr := newParallelReader(guard.countIn(src), runtime.GOMAXPROCS(0))
+	defer szr.Close()
+
+	return io.Copy(dst, guard.countFile(guard.countOut(szr)))
+}
+
+// Decode every chunk of a snappy stream, verifying each chunk's checksum.
+// If the stream holds a tar archive, make sure the archive can be read
+//   all the way to the end as well.
+func verifySz(src io.Reader) error {
+
+	szr := newParallelReader(src, runtime.GOMAXPROCS(0))
+	defer szr.Close()
+
+	unsnapped, unsnappedIsTar := sniffTar(szr)
+	if unsnappedIsTar {
+		if err := verifyTar(unsnapped); err != nil {
+			return err
+		}
 	}
 
-	return dstName, nil
+	// Decode whatever follows, e.g., the padding after a tar archive.
+	_, err := io.Copy(ioutil.Discard, unsnapped)
+	return err
 }
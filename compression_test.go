@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Compress `data` into a snappy stream without metadata.
+func snapTestStream(t *testing.T, data []byte) []byte {
+
+	var sz bytes.Buffer
+	if _, err := snap(&sz, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return sz.Bytes()
+}
+
+// TestVerifySz tests that verifySz accepts intact archives
+//   and reports a corrupt chunk or a truncated tar archive as corrupt.
+func TestVerifySz(t *testing.T) {
+
+	data := framingTestData(2*SnappyMaxUncompressedChunkLen + 7)
+	tarball := buildTar(t, []tarEntry{
+		{name: "top/", typeflag: tar.TypeDir},
+		{name: "top/file", typeflag: tar.TypeReg, contents: strings.Repeat("snapzip ", 4096)},
+	}).Bytes()
+
+	valid := map[string][]byte{
+		"file": snapTestStream(t, data),
+		"tar":  snapTestStream(t, tarball),
+	}
+
+	for name, stream := range valid {
+		if err := verifySz(bytes.NewReader(stream)); err != nil {
+			t.Errorf("Expected %v archive to verify but got %v.\n", name, err)
+		}
+	}
+
+	// Change the checksum of the first data chunk,
+	//   and cut the tar archive off in the middle of its file.
+	corrupt := map[string][]byte{
+		"corrupt chunk": flipByte(valid["file"], len(snappySignature)+chunkHeaderLen),
+		"truncated tar": snapTestStream(t, tarball[:3*512+100]),
+	}
+
+	for name, stream := range corrupt {
+		err := verifySz(bytes.NewReader(stream))
+		if err == nil || !isCorrupt(err) {
+			t.Errorf("Expected %v to be reported as corrupt but got %v.\n", name, err)
+		}
+	}
+}
+
+// TestSnapFileFailure tests that a file which fails to compress
+//   leaves neither a temporary file nor a partial archive behind.
+func TestSnapFileFailure(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := framingTestData(3 * SnappyMaxUncompressedChunkLen)
+	src := tempFileWith(t, root, "data", data)
+	defer src.Close()
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail partway through the file.
+	errRead := errors.New("read error")
+	r := &errorReader{bytes.NewReader(data[:len(data)/2]), errRead}
+	if _, err := snapFile(src, srcInfo, r); err == nil {
+		t.Fatal("Expected compression to fail.")
+	}
+
+	left, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range left {
+		if fi.Name() != "data" {
+			t.Errorf("Expected nothing to be left behind but found %v.\n", fi.Name())
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"archive/tar"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	print = fmt.Println
+	// report prints results which are the point of running a mode,
+	//   e.g., --test; only -q silences it.
+	report = fmt.Println
 )
 
 // Print help and exit with a status code.
@@ -19,17 +27,275 @@ func printHelp() {
 Usage: snapzip [option ...] [file ...]
 Description:
     Compress/uncompress files to/from snappy archives.
+    With no file, or when file is -, read from stdin and write to stdout.
 Options:
     -q                Do not show any output
+    -c, --stdout      Write output to stdout; keep original files
+    -z, --compress    Compress every file, even ones already compressed
+    -d, --decompress  Decompress every file; fail on any other file
+    -t, --test        Test the integrity of compressed files
+    -l, --list        List the contents of compressed tar archives
+    --json            With --list, print each entry as a JSON object
+    -x, --extract <archive> [member ...]
+                      Extract only the members of a compressed tar
+                        archive matching the patterns given after it,
+                        e.g., 'conf/*.yaml' or path/to/file
+    --to-stdout       With -x, write the members to stdout
     --dst-dir <path>  Place files under <path>
+    --rm              Remove each source file once its output
+                        has been written and flushed to disk
+    -k, --keep        Keep source files (the default)
+    --verify          Check each output file against its input
+                        by reading it back, e.g., before --rm
+    -r, --recursive   Compress (or, with -d, decompress) every file in
+                        directories on its own, instead of tarring them;
+                        skip snappy archives unless -z is given
+    --min-size <size>     With -r, skip files smaller than <size>
+    --skip-compressed     With -r, skip files in other compressed formats,
+                            e.g., gzip, xz, zstd, zip, jpeg, or png
+    -o, --output <archive>  Bundle every file and directory into
+                              a single tar archive, keeping their paths
+    --files-from <file>     Read files to process from <file>,
+                              one per line
+    --no-preserve     Do not copy permissions, timestamps, or ownership
+                        (as root) from each file or tar entry to its output
+    --numeric-owner   Use uids and gids, not user and group names,
+                        when creating or extracting tar archives
+    --owner <user>    Record <user> as the owner of archived files;
+                        a name, a uid, or name:uid
+    --group <group>   Record <group> as the group of archived files;
+                        a name, a gid, or name:gid
+    -j, --jobs <n>    Process at most <n> files at once
+                        (default: the number of CPUs)
+    --max-output <size>     Stop decompressing an archive
+                              once it outputs more than <size> bytes
+    --max-file-size <size>  Stop once any one output file
+                              is larger than <size> bytes
+    --max-entries <n>       Stop once a tar archive
+                              has more than <n> entries
+    --max-ratio <r>         Stop once an archive expands to more than
+                              <r> times its compressed size
+    --untrusted       Set safe limits for untrusted archives
+                        (1G output, 256M per file, 10000 entries,
+                        ratio 20) unless set otherwise
+    --exclude <pattern>       Leave files matching <pattern>
+                                out of tar archives, e.g., node_modules
+    --exclude-from <file>     Read exclude patterns from <file>
+    --include <pattern>       Only put files matching <pattern>
+                                in tar archives, e.g., '*.go'
+    --exclude-vcs             Leave out .git and other version control
+                                files and directories
+    --exclude-vcs-ignores     Leave out files ignored by .gitignore files
+    --exclude-caches          Leave out the contents of directories
+                                tagged with CACHEDIR.TAG
+    --sparse          Leave holes in decompressed or extracted files
+                        for blocks of zeros, to save disk space
+    -N, --name        Restore the name, mode, and mtime of compressed
+                        files when decompressing
+    -n, --no-name     Do not store the name, size, mode, and mtime of
+                        compressed files, which are stored by default
+    --sha256          Store a SHA-256 digest of compressed files,
+                        which is checked when decompressing
+    --seekable        Write a seek table at the end of each archive,
+                        so members can be listed or extracted
+                        without decoding the whole archive
+    --no-xattrs       Do not archive or restore extended attributes
+    --xattrs-include <pattern>  Only archive and restore xattrs matching
+                                  <pattern>, e.g., user or 'user.*'
+    --xattrs-exclude <pattern>  Never archive or restore xattrs matching
+                                  <pattern>, e.g., security.selinux
+    --                Treat every later argument as a file
+Exit status:
+    0 if every file succeeded, 1 if any file failed,
+    2 for a usage error, 3 if any file was corrupt.
 Notes:
-    This program automatically determines whether a file should be
-      compressed or decompressed.
+    Unless -z or -d is given, this program automatically determines
+      whether a file should be compressed or decompressed.
     This program can also compress directories;
-      they are added to a tar archive prior to compression.`,
+      they are added to a tar archive prior to compression.
+    Sizes may end in K, M, G, or T, e.g., 512M.
+    By default, no limits are set.
+    Extended attributes, including POSIX ACLs and file capabilities,
+      are stored in tar archives as PAX records.
+    An xattr pattern with no "." or "*" names a whole namespace.
+    An exclude or include pattern with no "/" matches file names;
+      one with a "/" matches the ends of paths, e.g., 'src/*.o'.`,
 	)
 }
 
+// Format a tar header like `tar -tv` does.
+func headerLine(hdr *tar.Header) string {
+
+	// Show a device's major and minor numbers in place of its size.
+	size := fmt.Sprint(hdr.Size)
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		size = fmt.Sprintf("%v,%v", hdr.Devmajor, hdr.Devminor)
+	}
+
+	line := fmt.Sprintf(
+		"%v %v/%v %10v %v %v",
+		headerMode(hdr),
+		headerOwner(hdr.Uname, hdr.Uid),
+		headerOwner(hdr.Gname, hdr.Gid),
+		size,
+		hdr.ModTime.Format("2006-01-02 15:04"),
+		hdr.Name,
+	)
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		line = concat(line, " -> ", hdr.Linkname)
+	case tar.TypeLink:
+		line = concat(line, " link to ", hdr.Linkname)
+	}
+
+	return line
+}
+
+// Return a tar header's mode as a string, e.g., "drwxr-xr-x".
+func headerMode(hdr *tar.Header) string {
+
+	perm := os.FileMode(hdr.Mode).Perm().String()
+
+	// Swap the leading "-" for a character showing the type of entry.
+	var kind string
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		kind = "d"
+	case tar.TypeSymlink:
+		kind = "l"
+	case tar.TypeLink:
+		kind = "h"
+	case tar.TypeChar:
+		kind = "c"
+	case tar.TypeBlock:
+		kind = "b"
+	case tar.TypeFifo:
+		kind = "p"
+	default:
+		kind = "-"
+	}
+
+	return concat(kind, perm[1:])
+}
+
+// Return an owner's name, or the owner's id if the name is missing.
+func headerOwner(name string, id int) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(id)
+}
+
+// headerEntry is the JSON form of a tar header printed by --list --json.
+type headerEntry struct {
+	Archive  string    `json:"archive"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Mode     string    `json:"mode"`
+	UID      int       `json:"uid"`
+	GID      int       `json:"gid"`
+	Uname    string    `json:"uname,omitempty"`
+	Gname    string    `json:"gname,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Linkname string    `json:"linkname,omitempty"`
+	Devmajor *int64    `json:"devmajor,omitempty"`
+	Devminor *int64    `json:"devminor,omitempty"`
+}
+
+// Format a tar header as a single line of JSON.
+func headerJSON(srcName string, hdr *tar.Header) (string, error) {
+
+	entry := headerEntry{
+		Archive:  srcName,
+		Name:     hdr.Name,
+		Type:     headerType(hdr),
+		Mode:     fmt.Sprintf("%04o", os.FileMode(hdr.Mode).Perm()),
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		Size:     hdr.Size,
+		ModTime:  hdr.ModTime,
+		Linkname: hdr.Linkname,
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		entry.Devmajor, entry.Devminor = &hdr.Devmajor, &hdr.Devminor
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Return the type of a tar header's entry as a word.
+func headerType(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeCont, tar.TypeGNUSparse:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return "other"
+}
+
+// Print the outcome of processing a file.
+func printResult(r result) {
+	switch {
+	case r.err != nil:
+		printError(r.path, r.err)
+	case Mode == modeTest:
+		report(concat(r.path, ": OK"))
+	case r.dstName != "":
+		print(r.dstName)
+	}
+}
+
+// Print an error for a file to stderr.
+// Errors are printed even when 'DoQuiet' is set.
+func printError(path string, err error) {
+
+	// Don't repeat the path if the error already names it.
+	if pe, ok := err.(*os.PathError); ok && pe.Path == path {
+		err = pe.Err
+	}
+
+	if isCorrupt(err) {
+		fmt.Fprintf(os.Stderr, "%v: CORRUPT: %v\n", path, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+}
+
+// Print a warning about a file to stderr.
+// Warnings are for problems which don't stop the file from being
+//   processed, so they are printed even when 'DoQuiet' is set.
+func printWarning(path string, err error) {
+	fmt.Fprintf(os.Stderr, "snapzip: warning: %v: %v\n", path, err)
+}
+
+// Print a usage error to stderr and exit.
+func usageError(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "snapzip: %v\n", fmt.Sprintf(format, a...))
+	fmt.Fprintln(os.Stderr, "Try 'snapzip --help' for more information.")
+	os.Exit(exitUsage)
+}
+
 // Empty print func for when 'DoQuiet' is set.
 func printNoop(x ...interface{}) (int, error) {
 	return 0, nil
@@ -91,7 +357,9 @@ func (pt *passthru) updatePercentTransferred(nTransferred int) (percentRounded i
 
 	percentSinceLastPrint := percentTransferred - pt.percentTransferred
 	tooSoonToPrint := percentSinceLastPrint < 2
-	shouldPrint = (!tooSoonToPrint || percentRounded > 99)
+	// Don't print progress until the expected length is known.
+	unknownLength := (pt.nExpected == 0)
+	shouldPrint = !unknownLength && (!tooSoonToPrint || percentRounded > 99)
 
 	if !shouldPrint {
 		return
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"testing"
+	"time"
+)
+
+// TestHeaderLine tests that tar headers are listed like `tar -tv` lists them.
+func TestHeaderLine(t *testing.T) {
+
+	modTime := time.Date(2016, 5, 4, 3, 2, 1, 0, time.Local)
+
+	headers := map[string]*tar.Header{
+		"-rw-r--r-- user/group       1234 2016-05-04 03:02 top/file": {
+			Name: "top/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1234,
+			Uname: "user", Gname: "group", ModTime: modTime,
+		},
+		"drwxr-xr-x 1000/1000          0 2016-05-04 03:02 top/": {
+			Name: "top/", Typeflag: tar.TypeDir, Mode: 0755,
+			Uid: 1000, Gid: 1000, ModTime: modTime,
+		},
+		"lrwxrwxrwx user/group          0 2016-05-04 03:02 top/link -> file": {
+			Name: "top/link", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777,
+			Uname: "user", Gname: "group", ModTime: modTime,
+		},
+		"hrw-r--r-- user/group          0 2016-05-04 03:02 top/hard link to top/file": {
+			Name: "top/hard", Typeflag: tar.TypeLink, Linkname: "top/file", Mode: 0644,
+			Uname: "user", Gname: "group", ModTime: modTime,
+		},
+		"crw-rw-rw- root/root        1,3 2016-05-04 03:02 dev/null": {
+			Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3,
+			Uname: "root", Gname: "root", ModTime: modTime,
+		},
+	}
+
+	for expected, hdr := range headers {
+		if line := headerLine(hdr); line != expected {
+			t.Errorf("Expected %q but got %q.\n", expected, line)
+		}
+	}
+}
+
+// TestHeaderJSON tests that tar headers are listed as one line of JSON each,
+//   with device numbers only for devices.
+func TestHeaderJSON(t *testing.T) {
+
+	modTime := time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)
+
+	headers := map[string]*tar.Header{
+		`{"archive":"a.tar.sz","name":"top/file","type":"file","mode":"0644","uid":1000,"gid":100,"uname":"user","size":1234,"mtime":"2016-05-04T03:02:01Z"}`: {
+			Name: "top/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1234,
+			Uid: 1000, Gid: 100, Uname: "user", ModTime: modTime,
+		},
+		`{"archive":"a.tar.sz","name":"top/link","type":"symlink","mode":"0777","uid":0,"gid":0,"size":0,"mtime":"2016-05-04T03:02:01Z","linkname":"file"}`: {
+			Name: "top/link", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777,
+			ModTime: modTime,
+		},
+		`{"archive":"a.tar.sz","name":"dev/null","type":"char","mode":"0666","uid":0,"gid":0,"size":0,"mtime":"2016-05-04T03:02:01Z","devmajor":1,"devminor":3}`: {
+			Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3,
+			ModTime: modTime,
+		},
+	}
+
+	for expected, hdr := range headers {
+		line, err := headerJSON("a.tar.sz", hdr)
+		if err != nil {
+			t.Errorf("%v: %v\n", hdr.Name, err)
+			continue
+		}
+		if line != expected {
+			t.Errorf("Expected %v but got %v.\n", expected, line)
+		}
+	}
+}
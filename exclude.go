@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files and directories left out by --exclude-vcs,
+//   the same ones GNU tar leaves out.
+var vcsNames = map[string]bool{
+	"CVS": true, "RCS": true, "SCCS": true, ".cvsignore": true,
+	".git": true, ".gitignore": true, ".gitattributes": true, ".gitmodules": true,
+	".svn": true, ".arch-ids": true, "{arch}": true,
+	"=RELEASE-ID": true, "=meta-update": true, "=update": true,
+	".bzr": true, ".bzrignore": true, ".bzrtags": true,
+	".hg": true, ".hgignore": true, ".hgtags": true,
+	"_darcs": true,
+}
+
+// http://www.brynosaurus.com/cachedir/spec.html
+// A directory holding a file named cacheTagName which starts with
+//   cacheTagSignature is a cache, e.g., of thumbnails or build output.
+const (
+	cacheTagName      = "CACHEDIR.TAG"
+	cacheTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// excluder walks a directory for a tar archive,
+//   leaving out whatever the user asked to exclude.
+// Excluded directories are never descended into.
+type excluder struct {
+	root string
+	// The name of `root` in the archive.
+	rootName string
+
+	// Rules read from .gitignore files, by the directory they are in.
+	gitignores map[string][]ignoreRule
+	// Directories tagged as caches.
+	caches map[string]bool
+}
+
+// ignoreRule is a single pattern from a .gitignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Return an *excluder for the directory `root`,
+//   which is named `rootName` in the archive.
+func newExcluder(root string, rootName string) *excluder {
+	return &excluder{
+		root:       root,
+		rootName:   rootName,
+		gitignores: make(map[string][]ignoreRule),
+		caches:     make(map[string]bool),
+	}
+}
+
+// Walk the directory like filepath.Walk does,
+//   skipping every file which is excluded.
+func (e *excluder) walk(walkFn filepath.WalkFunc) error {
+	return filepath.Walk(e.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return walkFn(path, fi, err)
+		}
+
+		if e.excluded(path, fi) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			if err := e.enter(path); err != nil {
+				return err
+			}
+		}
+
+		return walkFn(path, fi, err)
+	})
+}
+
+// Read whatever a directory holds which affects its contents,
+//   i.e., its .gitignore file and cache tag.
+func (e *excluder) enter(dir string) error {
+
+	if DoExcludeVCSIgnores {
+		rules, err := readGitignore(filepath.Join(dir, ".gitignore"))
+		if err != nil {
+			return err
+		}
+		if rules != nil {
+			e.gitignores[dir] = rules
+		}
+	}
+
+	if DoExcludeCaches && isCacheDir(dir) {
+		e.caches[dir] = true
+	}
+
+	return nil
+}
+
+// Check whether a file should be left out of the archive.
+// The directory being archived is never left out.
+func (e *excluder) excluded(path string, fi os.FileInfo) bool {
+
+	if path == e.root {
+		return false
+	}
+
+	// Match patterns against the name the file has in the archive.
+	name, err := e.memberName(path)
+	if err != nil {
+		return false
+	}
+	base := fi.Name()
+
+	// Keep a cache directory and its tag, but nothing else in it.
+	if e.caches[filepath.Dir(path)] && base != cacheTagName {
+		return true
+	}
+
+	if DoExcludeVCS && vcsNames[base] {
+		return true
+	}
+
+	for _, pattern := range Excludes {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+
+	if DoExcludeVCSIgnores && e.ignored(path, fi.IsDir()) {
+		return true
+	}
+
+	// Directories are kept, so that included files have somewhere to go.
+	if len(Includes) != 0 && !fi.IsDir() {
+		for _, pattern := range Includes {
+			if matchName(pattern, name) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// Return the name a file under the directory has in the archive.
+func (e *excluder) memberName(path string) (string, error) {
+
+	rel, err := filepath.Rel(e.root, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(filepath.Join(e.rootName, rel)), nil
+}
+
+// Check whether a file is ignored by the .gitignore files
+//   of the directories above it.
+// Like git, the last matching rule wins, and rules in deeper directories
+//   come after those in the directories above them.
+func (e *excluder) ignored(path string, isDir bool) bool {
+
+	// List the directories above the file, from the top down.
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == e.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	ignored := false
+
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		for _, rule := range e.gitignores[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.re.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// Check whether an exclude or include pattern matches a file's name
+//   in the archive, e.g., "dir/src/main.o".
+// A pattern without a "/" matches the last element of the name,
+//   e.g., "*.o" or "node_modules".
+// Otherwise, it matches the end of the name, e.g., "src/*.o".
+func matchName(pattern string, name string) bool {
+
+	pattern = strings.TrimPrefix(strings.TrimSuffix(pattern, "/"), "./")
+
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(name))
+		return matched
+	}
+
+	for {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Check whether a directory is tagged as a cache.
+func isCacheDir(dir string) bool {
+
+	tag, err := os.Open(filepath.Join(dir, cacheTagName))
+	if err != nil {
+		return false
+	}
+	defer tag.Close()
+
+	signature := make([]byte, len(cacheTagSignature))
+	if _, err := tag.Read(signature); err != nil {
+		return false
+	}
+
+	return string(signature) == cacheTagSignature
+}
+
+// https://git-scm.com/docs/gitignore
+// Read the rules of a .gitignore file.
+// Return nil if there is no such file.
+func readGitignore(filename string) ([]ignoreRule, error) {
+
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []ignoreRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// Parse a line of a .gitignore file.
+// Return false if it holds no pattern, e.g., it is a comment.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+
+	var rule ignoreRule
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// E.g., "\#file" or "\!file".
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	// A pattern with a "/" anywhere but at its end is relative to
+	//   the .gitignore file's directory.
+	// Otherwise, it matches a name at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = concat("^", expr, "$")
+	} else {
+		expr = concat("^(.*/)?", expr, "$")
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, false
+	}
+	rule.re = re
+
+	return rule, true
+}
+
+// Convert a .gitignore glob to a regular expression.
+// "**" matches any number of directories,
+//   while "*" and "?" never match a "/".
+func globToRegexp(glob string) string {
+
+	var expr bytes.Buffer
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = concat("^", class[1:])
+			}
+			expr.WriteString(concat("[", class, "]"))
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestMatchName tests --exclude and --include patterns.
+func TestMatchName(t *testing.T) {
+
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"node_modules", "project/node_modules", true},
+		{"node_modules", "project/src/node_modules", true},
+		{"node_modules", "project/node_modules_old", false},
+		{"*.o", "project/src/main.o", true},
+		{"*.o", "project/src/main.go", false},
+		{"src/*.o", "project/src/main.o", true},
+		{"src/*.o", "project/lib/main.o", false},
+		{"project/build/", "project/build", true},
+		{"build", "project/src/build", true},
+		{"rc/build", "project/src/build", false},
+	}
+
+	for _, test := range tests {
+		if matched := matchName(test.pattern, test.name); matched != test.expected {
+			t.Errorf("Expected %q matching %q to be %v but got %v.\n",
+				test.pattern, test.name, test.expected, matched)
+		}
+	}
+}
+
+// TestIgnoreRule tests the patterns of .gitignore files.
+func TestIgnoreRule(t *testing.T) {
+
+	tests := []struct {
+		line     string
+		name     string
+		isDir    bool
+		expected bool
+	}{
+		{"*.log", "debug.log", false, true},
+		{"*.log", "logs/debug.log", false, true},
+		{"/*.log", "logs/debug.log", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/server/arch.txt", false, false},
+		{"doc/*.txt", "src/doc/notes.txt", false, false},
+		{"**/foo", "a/b/foo", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"abc/**", "abc/x/y", false, true},
+		{"file[0-9].txt", "file7.txt", false, true},
+		{"file[!0-9].txt", "file7.txt", false, false},
+		{"\\#notes", "#notes", false, true},
+	}
+
+	for _, test := range tests {
+		rule, ok := parseIgnoreRule(test.line)
+		if !ok {
+			t.Errorf("Expected %q to be a rule.\n", test.line)
+			continue
+		}
+		matched := rule.re.MatchString(test.name) && (!rule.dirOnly || test.isDir)
+		if matched != test.expected {
+			t.Errorf("Expected %q matching %q to be %v but got %v.\n",
+				test.line, test.name, test.expected, matched)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("Expected %q not to be a rule.\n", line)
+		}
+	}
+
+	if rule, _ := parseIgnoreRule("!keep.log"); !rule.negate {
+		t.Errorf("Expected \"!keep.log\" to be negated.\n")
+	}
+}
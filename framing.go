@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// https://github.com/google/snappy/blob/master/framing_format.txt
+// Chunk types of the snappy framing format.
+const (
+	chunkTypeCompressedData   = 0x00
+	chunkTypeUncompressedData = 0x01
+	chunkTypeStreamIdentifier = 0xff
+)
+
+const (
+	// Length of a chunk header: a type byte and a 3-byte length.
+	chunkHeaderLen = 4
+	// Length of the checksum at the start of every data chunk.
+	chunkChecksumLen = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// https://github.com/golang/snappy/blob/master/snappy.go
+// Return the masked CRC-32C checksum of a block of data,
+//   as stored in the snappy framing format.
+func crc(b []byte) uint32 {
+	c := crc32.Update(0, crcTable, b)
+	return uint32(c>>15|c<<17) + 0xa282ead8
+}
+
+// Encode a block of uncompressed data as a framed chunk,
+//   header and all.
+// Like snappy.Writer, store the data uncompressed
+//   if compressing it saves less than 12.5%.
+func encodeChunk(block []byte) []byte {
+
+	n := len(block)
+	compressed := snappy.Encode(nil, block)
+
+	chunkType := byte(chunkTypeCompressedData)
+	body := compressed
+	if len(compressed) >= n-n/8 {
+		chunkType = chunkTypeUncompressedData
+		body = block
+	}
+
+	chunkLen := chunkChecksumLen + len(body)
+	chunk := make([]byte, chunkHeaderLen+chunkLen)
+	chunk[0] = chunkType
+	chunk[1] = uint8(chunkLen >> 0)
+	chunk[2] = uint8(chunkLen >> 8)
+	chunk[3] = uint8(chunkLen >> 16)
+	binary.LittleEndian.PutUint32(chunk[chunkHeaderLen:], crc(block))
+	copy(chunk[chunkHeaderLen+chunkChecksumLen:], body)
+
+	return chunk
+}
+
+// parallelWriter compresses blocks of data on several goroutines at once
+//   and writes them, in order, as a snappy framed stream.
+// Every chunk but the last holds a full block, so its output is
+//   byte-for-byte the same as that of a *snappy.Writer fed whole blocks,
+//   e.g., by snapCopy.
+// Close must be called to flush the last block.
+type parallelWriter struct {
+	w io.Writer
+
+	// Uncompressed data waiting to fill a block.
+	block []byte
+	// Whether the stream identifier has been queued.
+	started bool
+
+	// Chunks being compressed, in the order they must be written.
+	// Each chunk arrives on its own channel once it is compressed.
+	// The capacity of `pending` bounds the number of blocks in memory.
+	pending chan chan []byte
+	done    chan struct{}
+
+	// Whether to write a seek table at the end of the stream.
+	indexed bool
+	// Number of bytes written, the offset of the first data chunk,
+	//   and the seek table entry of every data chunk.
+	offset    int64
+	dataStart int64
+	entries   []seekEntry
+
+	mu  sync.Mutex
+	err error
+}
+
+// Return a *parallelWriter which compresses on up to `workers` goroutines.
+func newParallelWriter(w io.Writer, workers int) *parallelWriter {
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	pw := &parallelWriter{
+		w:       w,
+		block:   make([]byte, 0, SnappyMaxUncompressedChunkLen),
+		pending: make(chan chan []byte, workers),
+		done:    make(chan struct{}),
+	}
+
+	go pw.drain()
+
+	return pw
+}
+
+// Write compressed chunks to the underlying writer in order.
+func (pw *parallelWriter) drain() {
+
+	defer close(pw.done)
+
+	for chanChunk := range pw.pending {
+		chunk := <-chanChunk
+		if pw.error() != nil {
+			continue
+		}
+		if _, err := pw.w.Write(chunk); err != nil {
+			pw.setError(err)
+			continue
+		}
+
+		isData := chunk[0] == chunkTypeCompressedData || chunk[0] == chunkTypeUncompressedData
+		if pw.indexed && isData {
+			if len(pw.entries) == 0 {
+				pw.dataStart = pw.offset
+			}
+			pw.entries = append(pw.entries, seekEntry{len(chunk), chunkDecodedLen(chunk)})
+		}
+		pw.offset += int64(len(chunk))
+	}
+}
+
+// Queue a chunk which needs no compression.
+func (pw *parallelWriter) queue(chunk []byte) {
+	chanChunk := make(chan []byte, 1)
+	chanChunk <- chunk
+	pw.pending <- chanChunk
+}
+
+// Queue the stream identifier, unless it has been already.
+func (pw *parallelWriter) start() {
+	if !pw.started {
+		pw.started = true
+		pw.queue(snappySignature)
+	}
+}
+
+// Compress a block on its own goroutine and queue the resulting chunk.
+func (pw *parallelWriter) queueBlock(block []byte) {
+
+	pw.start()
+
+	chanChunk := make(chan []byte, 1)
+	pw.pending <- chanChunk
+
+	go func() {
+		chanChunk <- encodeChunk(block)
+	}()
+}
+
+// Write buffers data into full blocks and queues each one for compression.
+func (pw *parallelWriter) Write(p []byte) (int, error) {
+
+	if err := pw.error(); err != nil {
+		return 0, err
+	}
+
+	nWritten := len(p)
+
+	for len(p) > 0 {
+		n := copy(pw.block[len(pw.block):cap(pw.block)], p)
+		pw.block = pw.block[:len(pw.block)+n]
+		p = p[n:]
+
+		if full := (len(pw.block) == cap(pw.block)); full {
+			pw.queueBlock(pw.block)
+			pw.block = make([]byte, 0, SnappyMaxUncompressedChunkLen)
+		}
+	}
+
+	return nWritten, nil
+}
+
+// Queue a chunk other than a data chunk, e.g., a skippable chunk,
+//   to be written after everything written so far.
+// Any partial block is flushed first, so this should only be done
+//   at the start or the end of the stream.
+func (pw *parallelWriter) writeChunk(chunk []byte) {
+
+	pw.start()
+
+	if len(pw.block) > 0 {
+		pw.queueBlock(pw.block)
+		pw.block = make([]byte, 0, SnappyMaxUncompressedChunkLen)
+	}
+
+	pw.queue(chunk)
+}
+
+// Close flushes the last block and waits for every chunk to be written.
+// If the stream is indexed, it then writes the seek table.
+// It does not close the underlying writer.
+func (pw *parallelWriter) Close() error {
+
+	if pw.pending == nil {
+		return pw.error()
+	}
+
+	if len(pw.block) > 0 {
+		pw.queueBlock(pw.block)
+		pw.block = nil
+	}
+
+	close(pw.pending)
+	<-pw.done
+	pw.pending = nil
+
+	if pw.indexed && pw.error() == nil {
+		if err := pw.writeSeekTable(); err != nil {
+			pw.setError(err)
+		}
+	}
+
+	return pw.error()
+}
+
+func (pw *parallelWriter) error() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *parallelWriter) setError(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.err = err
+}
+
+// Decode a chunk's body, i.e., everything after its header,
+//   and verify its checksum.
+func decodeChunk(chunkType byte, body []byte) ([]byte, error) {
+
+	if len(body) < chunkChecksumLen {
+		return nil, snappy.ErrCorrupt
+	}
+	checksum := binary.LittleEndian.Uint32(body)
+	body = body[chunkChecksumLen:]
+
+	var block []byte
+	switch chunkType {
+	case chunkTypeCompressedData:
+		n, err := snappy.DecodedLen(body)
+		if err != nil || n > SnappyMaxUncompressedChunkLen {
+			return nil, snappy.ErrCorrupt
+		}
+		if block, err = snappy.Decode(nil, body); err != nil {
+			return nil, err
+		}
+	case chunkTypeUncompressedData:
+		if len(body) > SnappyMaxUncompressedChunkLen {
+			return nil, snappy.ErrCorrupt
+		}
+		block = body
+	}
+
+	if crc(block) != checksum {
+		return nil, snappy.ErrCorrupt
+	}
+
+	return block, nil
+}
+
+// decodedChunk is the result of decoding one chunk.
+// For chunks other than data chunks, which need no decoding,
+//   it holds the chunk's type and body instead.
+type decodedChunk struct {
+	block []byte
+	err   error
+
+	chunkType byte
+	body      []byte
+}
+
+// parallelReader reads a snappy framed stream ahead of its caller,
+//   decodes and verifies chunks on several goroutines at once,
+//   and returns the uncompressed data in order.
+// Close should be called if the stream is not read to the end.
+type parallelReader struct {
+	// Uncompressed data left over from the last chunk.
+	block []byte
+	err   error
+
+	// Chunks being decoded, in the order they must be read.
+	// The capacity of `pending` bounds the read-ahead window.
+	pending chan chan decodedChunk
+	stop    chan struct{}
+
+	// Metadata about the original file, from the first stream read,
+	//   and the checks made against the metadata of the current stream.
+	metadata *fileMetadata
+	check    streamCheck
+}
+
+// Return a *parallelReader which decodes on up to `workers` goroutines.
+func newParallelReader(r io.Reader, workers int) *parallelReader {
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	pr := &parallelReader{
+		pending: make(chan chan decodedChunk, workers),
+		stop:    make(chan struct{}),
+	}
+
+	go pr.readAhead(r)
+
+	return pr
+}
+
+// Return the error to report when reading a chunk fails with `err`.
+// A stream which ends in the middle of a chunk is corrupt,
+//   but any other error, e.g., from the disk, is passed on as it is.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return snappy.ErrCorrupt
+	}
+	return err
+}
+
+// Split the stream into chunks and queue each data chunk for decoding.
+func (pr *parallelReader) readAhead(r io.Reader) {
+
+	defer close(pr.pending)
+
+	header := make([]byte, chunkHeaderLen)
+	started := false
+
+	for {
+		// A stream may only end between chunks.
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				pr.queue(decodedChunk{err: readError(err)})
+			}
+			return
+		}
+		chunkType := header[0]
+		chunkLen := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+
+		body := make([]byte, chunkLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			pr.queue(decodedChunk{err: readError(err)})
+			return
+		}
+
+		// The stream must start with a stream identifier.
+		// It may be repeated, e.g., when streams are concatenated.
+		if chunkType == chunkTypeStreamIdentifier {
+			if !bytes.Equal(header, snappySignature[:chunkHeaderLen]) ||
+				!bytes.Equal(body, snappySignature[chunkHeaderLen:]) {
+				pr.queue(decodedChunk{err: snappy.ErrCorrupt})
+				return
+			}
+			started = true
+			pr.queue(decodedChunk{chunkType: chunkType})
+			continue
+		}
+		if !started {
+			pr.queue(decodedChunk{err: snappy.ErrCorrupt})
+			return
+		}
+
+		switch {
+		case chunkType == chunkTypeCompressedData || chunkType == chunkTypeUncompressedData:
+			// Decode it below.
+		case chunkType == chunkTypeMetadata || chunkType == chunkTypeDigest:
+			// Pass them on in order, to check the data against.
+			pr.queue(decodedChunk{chunkType: chunkType, body: body})
+			continue
+		case chunkType >= 0x80:
+			// Skip padding and other skippable chunks.
+			continue
+		default:
+			// Reserved, unskippable chunks.
+			pr.queue(decodedChunk{err: snappy.ErrUnsupported})
+			return
+		}
+
+		chanChunk := make(chan decodedChunk, 1)
+		select {
+		case pr.pending <- chanChunk:
+		case <-pr.stop:
+			return
+		}
+
+		go func() {
+			block, err := decodeChunk(chunkType, body)
+			chanChunk <- decodedChunk{block: block, err: err}
+		}()
+	}
+}
+
+// Queue a chunk which needs no decoding, e.g., an error.
+func (pr *parallelReader) queue(d decodedChunk) {
+	chanChunk := make(chan decodedChunk, 1)
+	chanChunk <- d
+	select {
+	case pr.pending <- chanChunk:
+	case <-pr.stop:
+	}
+}
+
+// Read returns uncompressed data in the order it was written.
+func (pr *parallelReader) Read(p []byte) (int, error) {
+
+	for len(pr.block) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+
+		chanChunk, ok := <-pr.pending
+		if !ok {
+			if pr.err = pr.check.end(); pr.err == nil {
+				pr.err = io.EOF
+			}
+			continue
+		}
+
+		d := <-chanChunk
+		switch d.chunkType {
+		case chunkTypeStreamIdentifier:
+			// The previous stream, if any, has ended.
+			pr.err = pr.check.end()
+		case chunkTypeMetadata:
+			if m := decodeMetadata(d.body); m != nil {
+				if pr.metadata == nil {
+					pr.metadata = m
+				}
+				pr.check.start(m)
+			}
+		case chunkTypeDigest:
+			pr.err = pr.check.checkDigest(d.body)
+		default:
+			pr.block, pr.err = d.block, d.err
+			pr.check.write(d.block)
+		}
+	}
+
+	n := copy(p, pr.block)
+	pr.block = pr.block[n:]
+
+	return n, nil
+}
+
+// Metadata returns the metadata about the original file
+//   stored at the start of the stream, or nil if there is none.
+// It is known once anything has been read.
+func (pr *parallelReader) Metadata() *fileMetadata {
+	return pr.metadata
+}
+
+// Close stops reading ahead.
+// It does not close the underlying reader.
+func (pr *parallelReader) Close() error {
+	select {
+	case <-pr.stop:
+	default:
+		close(pr.stop)
+	}
+	return nil
+}
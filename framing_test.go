@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// Return data which compresses somewhat, but not completely.
+func framingTestData(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, n)
+	for i := range data {
+		if rng.Intn(4) == 0 {
+			data[i] = byte(rng.Intn(256))
+		} else {
+			data[i] = byte(i % 64)
+		}
+	}
+	return data
+}
+
+// TestParallelWriter tests that *parallelWriter output matches
+//   *snappy.Writer output and decodes back to its input.
+func TestParallelWriter(t *testing.T) {
+
+	data := framingTestData(5*SnappyMaxUncompressedChunkLen + 123)
+
+	var expected bytes.Buffer
+	sz := snappy.NewWriter(&expected)
+	buf := make([]byte, SnappyMaxUncompressedChunkLen)
+	if _, err := io.CopyBuffer(sz, bytes.NewReader(data), buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write in pieces which don't line up with blocks.
+	for _, writeLen := range []int{1000, SnappyMaxUncompressedChunkLen, 100000} {
+
+		var got bytes.Buffer
+		pw := newParallelWriter(&got, 4)
+		for p := data; len(p) > 0; {
+			n := writeLen
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := pw.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got.Bytes(), expected.Bytes()) {
+			t.Errorf("Expected output for writes of %v bytes to match *snappy.Writer.\n", writeLen)
+			continue
+		}
+
+		unsnapped, err := ioutil.ReadAll(snappy.NewReader(&got))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(unsnapped, data) {
+			t.Errorf("Expected output for writes of %v bytes to decode to the input.\n", writeLen)
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		var got bytes.Buffer
+		pw := newParallelWriter(&got, 4)
+		if err := pw.Close(); err != nil {
+			t.Error(err)
+			return
+		}
+		if got.Len() != 0 {
+			t.Errorf("Expected no output but got %v bytes.\n", got.Len())
+		}
+	})
+}
+
+// TestParallelReader tests that *parallelReader decodes what
+//   *snappy.Writer encodes and rejects corrupt streams.
+func TestParallelReader(t *testing.T) {
+
+	data := framingTestData(5*SnappyMaxUncompressedChunkLen + 123)
+
+	var snapped bytes.Buffer
+	sz := snappy.NewBufferedWriter(&snapped)
+	if _, err := sz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	valid := snapped.Bytes()
+
+	t.Run("valid", func(t *testing.T) {
+		pr := newParallelReader(bytes.NewReader(valid), 4)
+		defer pr.Close()
+		got, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Expected the stream to decode to its input.\n")
+		}
+	})
+
+	t.Run("concatenated", func(t *testing.T) {
+		twice := append(append([]byte{}, valid...), valid...)
+		pr := newParallelReader(bytes.NewReader(twice), 4)
+		defer pr.Close()
+		got, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, append(append([]byte{}, data...), data...)) {
+			t.Errorf("Expected concatenated streams to decode to both inputs.\n")
+		}
+	})
+
+	t.Run("skippable", func(t *testing.T) {
+		skippable := []byte{0xfe, 3, 0, 0, 1, 2, 3}
+		stream := append(append([]byte{}, valid...), skippable...)
+		pr := newParallelReader(bytes.NewReader(stream), 4)
+		defer pr.Close()
+		got, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Expected skippable chunks to be skipped.\n")
+		}
+	})
+
+	corrupt := map[string][]byte{
+		"checksum":   flipByte(valid, len(valid)-1),
+		"truncated":  valid[:len(valid)-10],
+		"header":     valid[:len(snappySignature)+2],
+		"identifier": valid[len(snappySignature):],
+	}
+
+	for name, stream := range corrupt {
+		t.Run(name, func(t *testing.T) {
+			pr := newParallelReader(bytes.NewReader(stream), 4)
+			defer pr.Close()
+			_, err := ioutil.ReadAll(pr)
+			if err != snappy.ErrCorrupt {
+				t.Errorf("Expected %v but got %v.\n", snappy.ErrCorrupt, err)
+			}
+		})
+	}
+}
+
+// errorReader reads from `r` and then fails with `err`.
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errorReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err == io.EOF {
+		err = er.err
+	}
+	return n, err
+}
+
+// TestParallelReaderError tests that errors reading a stream
+//   are passed on, rather than reported as corruption.
+func TestParallelReaderError(t *testing.T) {
+
+	valid := snapTestStream(t, framingTestData(3*SnappyMaxUncompressedChunkLen))
+	errRead := errors.New("read error")
+
+	// Fail between two chunks and in the middle of one.
+	for _, n := range []int{len(snappySignature), len(snappySignature) + chunkHeaderLen + 10} {
+		r := &errorReader{bytes.NewReader(valid[:n]), errRead}
+		pr := newParallelReader(r, 4)
+		_, err := ioutil.ReadAll(pr)
+		pr.Close()
+		if err != errRead {
+			t.Errorf("Expected %v after %v bytes but got %v.\n", errRead, n, err)
+		}
+	}
+}
+
+// Return a copy of `b` with one byte changed.
+func flipByte(b []byte, i int) []byte {
+	flipped := append([]byte{}, b...)
+	flipped[i] ^= 0xff
+	return flipped
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Limits used by --untrusted for any limit the user didn't set.
+const (
+	untrustedMaxOutput   = 1 << 30
+	untrustedMaxFileSize = 256 << 20
+	untrustedMaxEntries  = 10000
+	untrustedMaxRatio    = 20
+)
+
+// Don't hold small archives to the expansion ratio;
+//   a few repeated bytes can expand a great deal without harm.
+const minRatioOutput = 1 << 20
+
+// Set safe limits for extracting untrusted archives,
+//   keeping any limit the user set explicitly.
+func setUntrustedLimits() {
+	if MaxOutput == 0 {
+		MaxOutput = untrustedMaxOutput
+	}
+	if MaxFileSize == 0 {
+		MaxFileSize = untrustedMaxFileSize
+	}
+	if MaxEntries == 0 {
+		MaxEntries = untrustedMaxEntries
+	}
+	if MaxRatio == 0 {
+		MaxRatio = untrustedMaxRatio
+	}
+}
+
+// limitError reports an archive which passed one of the limits
+//   set by the user.
+type limitError struct {
+	limit string
+	value string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("limit exceeded: %v (%v)", e.limit, e.value)
+}
+
+// bombGuard counts what an archive expands to and stops it
+//   as soon as it passes any limit set by the user.
+type bombGuard struct {
+	nIn      uint64 // Compressed bytes read, updated while reading ahead
+	nOut     uint64 // Uncompressed bytes read
+	nEntries int    // Tar entries read
+	nSizes   uint64 // Sizes of tar entries read, counting holes
+}
+
+// countingReader forwards reads and tells its guard how much was read.
+type countingReader struct {
+	io.Reader
+	count func(n int) error
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.Reader.Read(b)
+	if countErr := cr.count(n); countErr != nil {
+		return n, countErr
+	}
+	return n, err
+}
+
+// countingReadSeeker is a countingReader which can also seek,
+//   so that tar can skip over members without reading them.
+type countingReadSeeker struct {
+	*countingReader
+	io.Seeker
+}
+
+// Wrap the compressed stream of an archive.
+func (g *bombGuard) countIn(r io.Reader) io.Reader {
+	return &countingReader{r, func(n int) error {
+		g.addIn(n)
+		return nil
+	}}
+}
+
+// Count compressed bytes of an archive which were read
+//   other than through countIn, e.g., chunks found with a seek table.
+func (g *bombGuard) addIn(n int) {
+	atomic.AddUint64(&g.nIn, uint64(n))
+}
+
+// Wrap the uncompressed stream of an archive.
+// Stop once it passes --max-output or --max-ratio.
+func (g *bombGuard) countOut(r io.Reader) io.Reader {
+	return &countingReader{r, g.addOut}
+}
+
+// Wrap the uncompressed contents of an archive read with a seek table,
+//   which can still seek, as countOut does.
+// Only what is read is counted, not what is skipped.
+func (g *bombGuard) countOutSeeker(rs io.ReadSeeker) io.ReadSeeker {
+	return &countingReadSeeker{&countingReader{rs, g.addOut}, rs}
+}
+
+// Count uncompressed bytes read.
+// Stop once they pass --max-output or --max-ratio.
+func (g *bombGuard) addOut(n int) error {
+	g.nOut += uint64(n)
+	if MaxOutput != 0 && g.nOut > MaxOutput {
+		return &limitError{"--max-output", fmt.Sprintf("%d bytes", MaxOutput)}
+	}
+	nIn := atomic.LoadUint64(&g.nIn)
+	if MaxRatio != 0 && g.nOut > minRatioOutput && nIn != 0 &&
+		float64(g.nOut)/float64(nIn) > MaxRatio {
+		return &limitError{"--max-ratio", fmt.Sprint(MaxRatio)}
+	}
+	return nil
+}
+
+// Wrap the uncompressed stream of an archive which holds a single file.
+// Stop once it passes --max-file-size.
+func (g *bombGuard) countFile(r io.Reader) io.Reader {
+	var nFile uint64
+	return &countingReader{r, func(n int) error {
+		nFile += uint64(n)
+		if MaxFileSize != 0 && nFile > MaxFileSize {
+			return &limitError{"--max-file-size", fmt.Sprintf("%d bytes", MaxFileSize)}
+		}
+		return nil
+	}}
+}
+
+// Count a tar entry before it is extracted.
+// Refuse it if it passes --max-entries, --max-file-size, or --max-output.
+func (g *bombGuard) checkEntry(hdr *tar.Header) error {
+
+	g.nEntries++
+	if MaxEntries != 0 && g.nEntries > MaxEntries {
+		return &limitError{"--max-entries", fmt.Sprint(MaxEntries)}
+	}
+
+	if MaxFileSize != 0 && uint64(hdr.Size) > MaxFileSize {
+		return &limitError{"--max-file-size", fmt.Sprintf("%d bytes", MaxFileSize)}
+	}
+
+	// A sparse file may be much larger than the data stored for it.
+	g.nSizes += uint64(hdr.Size)
+	if MaxOutput != 0 && g.nSizes > MaxOutput {
+		return &limitError{"--max-output", fmt.Sprintf("%d bytes", MaxOutput)}
+	}
+
+	return nil
+}
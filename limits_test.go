@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestUnsnapLimits tests that a snappy stream is stopped
+//   once it passes any limit.
+func TestUnsnapLimits(t *testing.T) {
+
+	defer func() { MaxOutput, MaxFileSize, MaxRatio = 0, 0, 0 }()
+
+	// Highly compressible data, as in a decompression bomb.
+	data := make([]byte, 4<<20)
+	var sz bytes.Buffer
+	if _, err := snap(&sz, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := map[string]func(){
+		"--max-output":    func() { MaxOutput = 1 << 20 },
+		"--max-file-size": func() { MaxFileSize = 1 << 20 },
+		"--max-ratio":     func() { MaxRatio = 20 },
+	}
+
+	for name, set := range limits {
+		t.Run(name, func(t *testing.T) {
+
+			MaxOutput, MaxFileSize, MaxRatio = 0, 0, 0
+			set()
+
+			n, err := unsnap(ioutil.Discard, bytes.NewReader(sz.Bytes()))
+			if _, ok := err.(*limitError); !ok || !strings.Contains(err.Error(), name) {
+				t.Errorf("Expected %v to be exceeded but got %v.\n", name, err)
+			}
+			if n >= int64(len(data)) {
+				t.Errorf("Expected decompression to stop early but got %v bytes.\n", n)
+			}
+		})
+	}
+
+	MaxOutput, MaxFileSize, MaxRatio = 0, 0, 0
+	if _, err := unsnap(ioutil.Discard, bytes.NewReader(sz.Bytes())); err != nil {
+		t.Errorf("Expected no limits by default but got %v.\n", err)
+	}
+}
+
+// TestUntarLimits tests that a tar archive with too many entries
+//   or too large an entry is refused and that nothing is left behind.
+func TestUntarLimits(t *testing.T) {
+
+	defer func() { MaxEntries, MaxFileSize = 0, 0 }()
+
+	archives := map[string][]tarEntry{
+		"--max-entries": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/a", typeflag: tar.TypeReg, contents: "a"},
+			{name: "top/b", typeflag: tar.TypeReg, contents: "b"},
+			{name: "top/c", typeflag: tar.TypeReg, contents: "c"},
+		},
+		"--max-file-size": {
+			{name: "top/", typeflag: tar.TypeDir},
+			{name: "top/big", typeflag: tar.TypeReg, contents: strings.Repeat("x", 100)},
+		},
+	}
+
+	MaxEntries, MaxFileSize = 3, 10
+
+	for name, entries := range archives {
+		t.Run(name, func(t *testing.T) {
+
+			root, err := ioutil.TempDir("", "snapzip-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			DstDir = filepath.Join(root, "dst")
+			defer func() { DstDir = "" }()
+			if err := os.Mkdir(DstDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = untar(name, buildTar(t, entries), &bombGuard{})
+			if _, ok := err.(*limitError); !ok || !strings.Contains(err.Error(), name) {
+				t.Errorf("Expected %v to be exceeded but got %v.\n", name, err)
+				return
+			}
+
+			left, err := ioutil.ReadDir(DstDir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(left) != 0 {
+				t.Errorf("Expected %v to be empty but found %v.\n", DstDir, left[0].Name())
+			}
+		})
+	}
+}
+
+// TestExtractSeekableLimits tests that an archive with a seek table
+//   is held to the same limits when members are extracted from it.
+func TestExtractSeekableLimits(t *testing.T) {
+
+	defer func(m mode) { Mode, MaxOutput, MaxRatio = m, 0, 0 }(Mode)
+	Mode = modeExtract
+
+	// Highly compressible data, as in a decompression bomb.
+	tarball := buildTar(t, []tarEntry{
+		{name: "top/", typeflag: tar.TypeDir},
+		{name: "top/zeros", typeflag: tar.TypeReg, contents: strings.Repeat("\x00", 4<<20)},
+	}).Bytes()
+
+	limits := map[string]func(){
+		"--max-output": func() { MaxOutput = 1 << 20 },
+		"--max-ratio":  func() { MaxRatio = 20 },
+	}
+
+	for name, set := range limits {
+		t.Run(name, func(t *testing.T) {
+
+			root, err := ioutil.TempDir("", "snapzip-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			src := tempFileWith(t, root, "bomb.tar.sz", seekableTestStream(t, tarball))
+			src.Close()
+
+			DstDir = filepath.Join(root, "dst")
+			defer func() { DstDir = "" }()
+			if err := os.Mkdir(DstDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			MaxOutput, MaxRatio = 0, 0
+			set()
+
+			_, err = extract(src.Name())
+			if _, ok := err.(*limitError); !ok || !strings.Contains(err.Error(), name) {
+				t.Errorf("Expected %v to be exceeded but got %v.\n", name, err)
+				return
+			}
+
+			left, err := ioutil.ReadDir(DstDir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(left) != 0 {
+				t.Errorf("Expected %v to be empty but found %v.\n", DstDir, left[0].Name())
+			}
+		})
+	}
+}
+
+// TestParseSize tests sizes with and without units.
+func TestParseSize(t *testing.T) {
+
+	sizes := map[string]uint64{
+		"0":    0,
+		"4096": 4096,
+		"64K":  64 << 10,
+		"512m": 512 << 20,
+		"2G":   2 << 30,
+		"1TiB": 1 << 40,
+		"10MB": 10 << 20,
+	}
+
+	for s, expected := range sizes {
+		size, err := parseSize(s)
+		if err != nil || size != expected {
+			t.Errorf("Expected %v to be %v but got %v (%v).\n", s, expected, size, err)
+		}
+	}
+
+	// The largest size in TiB, and sizes too large to hold.
+	if size, err := parseSize("16777215T"); err != nil || size != 16777215<<40 {
+		t.Errorf("Expected the largest size in TiB to be valid but got %v (%v).\n", size, err)
+	}
+
+	for _, s := range []string{"", "K", "-1", "1.5G", "12X", "16777216T", "18446744073709551616"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Expected %q to be invalid.\n", s)
+		}
+	}
+}
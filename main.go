@@ -1,10 +1,44 @@
 package main
 
 import (
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"os/user"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+)
+
+// StdioPath is the filepath that stands for stdin (as a source)
+//   or stdout (as a destination).
+const StdioPath = "-"
+
+// mode is what to do with each file.
+type mode int
+
+const (
+	// Compress or decompress each file depending on its contents.
+	modeAuto mode = iota
+	modeCompress
+	modeDecompress
+	modeTest
+	modeList
+	modeExtract
+)
+
+// Exit statuses.
+const (
+	exitOK      = 0
+	exitFailure = 1 // At least one file failed.
+	exitUsage   = 2 // The arguments were invalid.
+	exitCorrupt = 3 // At least one file was corrupt.
 )
 
 var (
@@ -14,24 +48,95 @@ var (
 	Files []string
 	// DstDir is the optional location to place compressed/uncompressed files
 	DstDir string
-	// doBring         bool
-	// doSingleArchive bool
-	// dstArchive      string
+	// DoStdout means write compressed/uncompressed data to stdout
+	DoStdout bool
+	// Jobs is the maximum number of files processed at once
+	Jobs = runtime.GOMAXPROCS(0)
+	// Mode is what to do with each file; auto-detected by default
+	Mode mode
+	// DoPreserve means copy permissions, timestamps, and ownership
+	//   from each source file to its output
+	DoPreserve = true
+	// DoJSON means print --list output as JSON, one entry per line
+	DoJSON bool
+	// MaxOutput is the most bytes an archive may extract to; 0 means no limit
+	MaxOutput uint64
+	// MaxFileSize is the most bytes any one extracted file may hold
+	MaxFileSize uint64
+	// MaxEntries is the most files a tar archive may extract to
+	MaxEntries int
+	// MaxRatio is the most an archive may expand relative to its size
+	MaxRatio float64
+	// doUntrusted means fill in safe limits for any not set by the user
+	doUntrusted bool
+	// DoXattrs means archive and restore extended attributes
+	DoXattrs = true
+	// XattrsInclude are the only xattr namespaces or patterns to archive
+	//   and restore, if any are given
+	XattrsInclude []string
+	// XattrsExclude are xattr namespaces or patterns never to archive
+	//   or restore
+	XattrsExclude []string
+	// DoNumericOwner means use uids and gids, not user and group names,
+	//   in tar archives
+	DoNumericOwner bool
+	// Owner is the user to record as the owner of every archived file
+	Owner *owner
+	// Group is the group to record as the group of every archived file
+	Group *owner
+	// DoSparse means leave holes in output files for blocks of zeros
+	DoSparse bool
+	// DoSeekable means write a seek table at the end of snappy archives
+	DoSeekable bool
+	// DoRecursive means compress or decompress every file in directories
+	//   on its own, instead of adding directories to tar archives
+	DoRecursive bool
+	// MinSize is the size below which -r leaves files uncompressed
+	MinSize uint64
+	// DoSkipCompressed means -r leaves files in other compressed
+	//   formats uncompressed
+	DoSkipCompressed bool
+	// DoRemove means remove source files once their output is on disk
+	DoRemove bool
+	// DoVerify means check output files against the data written to them
+	DoVerify bool
+	// DoMetadata means store the name and other metadata of compressed files
+	DoMetadata = true
+	// DoName means restore the name and other metadata of files
+	//   when decompressing
+	DoName bool
+	// DoDigest means store a SHA-256 digest of compressed files
+	//   along with their metadata
+	DoDigest bool
+	// Excludes are patterns of files to leave out of tar archives
+	Excludes []string
+	// Includes are patterns of the only files to put in tar archives,
+	//   if any are given
+	Includes []string
+	// DoExcludeVCS means leave version control files out of tar archives
+	DoExcludeVCS bool
+	// DoExcludeVCSIgnores means leave files ignored by .gitignore files
+	//   out of tar archives
+	DoExcludeVCSIgnores bool
+	// DoExcludeCaches means leave the contents of cache directories
+	//   out of tar archives
+	DoExcludeCaches bool
+	// DstArchive is the tar archive to bundle every file into, if any
+	DstArchive string
+	// Members are patterns of the members to extract with -x;
+	//   with none, every member is extracted
+	Members []string
+	// DoToStdout means write the members extracted with -x to stdout
+	DoToStdout bool
 )
 
-func init() {
-	if helpRequested() {
-		printHelp()
-		os.Exit(0)
-	}
-	setGlobalVars()
-}
-
 // Check whether the user requested help.
 func helpRequested() bool {
 
+	// With no arguments, read from stdin if it is a pipe,
+	//   e.g., `pg_dump | snapzip > db.sz`.
 	if tooFewArgs := (len(os.Args) < 2); tooFewArgs {
-		return true
+		return !stdinIsPipe()
 	}
 
 	switch os.Args[1] {
@@ -47,29 +152,177 @@ func helpRequested() bool {
 func setGlobalVars() {
 
 	max := len(os.Args)
+	endOfOptions := false
 
 	for i := 1; i < max; i++ {
 		arg := os.Args[i]
 
+		// Treat everything after "--" as a file.
+		if endOfOptions {
+			Files = append(Files, arg)
+			continue
+		}
+
+		// Split "--option=value" into the option and its value.
+		var value string
+		hasValue := false
+		if eq := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && eq > 0 {
+			arg, value, hasValue = arg[:eq], arg[eq+1:], true
+		}
+
+		// Return the value of an option which takes one,
+		//   either from "--option=value" or from the next argument.
+		optionValue := func() string {
+			if !hasValue {
+				i, value = nextArg(i)
+			}
+			return value
+		}
+
 		switch arg {
+		case "--":
+			endOfOptions = true
 		case "-q":
 			DoQuiet = true
+			report = printNoop
+		case "-c", "--stdout":
+			DoStdout = true
+		case "-z", "--compress":
+			setMode(arg, modeCompress)
+		case "-d", "--decompress":
+			setMode(arg, modeDecompress)
+		case "-t", "--test":
+			setMode(arg, modeTest)
+		case "-l", "--list":
+			setMode(arg, modeList)
+		case "-x", "--extract":
+			setMode(arg, modeExtract)
+		case "--to-stdout":
+			DoToStdout = true
+		case "--json":
+			DoJSON = true
+		case "--no-preserve":
+			DoPreserve = false
 		case "--dst-dir":
-			i, arg = nextArg(i)
-			DstDir = arg
+			DstDir = optionValue()
+		case "-j", "--jobs":
+			setJobs(optionValue())
+		case "--max-output":
+			MaxOutput = sizeArg(arg, optionValue())
+		case "--max-file-size":
+			MaxFileSize = sizeArg(arg, optionValue())
+		case "--max-entries":
+			MaxEntries = intArg(arg, optionValue())
+		case "--max-ratio":
+			MaxRatio = countArg(arg, optionValue())
+		case "--untrusted":
+			doUntrusted = true
+		case "--no-xattrs":
+			DoXattrs = false
+		case "--xattrs-include":
+			XattrsInclude = append(XattrsInclude, optionValue())
+		case "--xattrs-exclude":
+			XattrsExclude = append(XattrsExclude, optionValue())
+		case "--sparse":
+			DoSparse = true
+		case "--seekable":
+			DoSeekable = true
+		case "-r", "--recursive":
+			DoRecursive = true
+		case "--min-size":
+			MinSize = sizeArg(arg, optionValue())
+		case "--skip-compressed":
+			DoSkipCompressed = true
+		case "--rm":
+			DoRemove = true
+		case "-k", "--keep":
+			DoRemove = false
+		case "--verify":
+			DoVerify = true
+		case "-N", "--name":
+			DoName = true
+		case "-n", "--no-name":
+			DoMetadata = false
+		case "--sha256":
+			DoDigest = true
+		case "--exclude":
+			Excludes = append(Excludes, optionValue())
+		case "--exclude-from":
+			Excludes = append(Excludes, linesArg(arg, optionValue())...)
+		case "--include":
+			Includes = append(Includes, optionValue())
+		case "--exclude-vcs":
+			DoExcludeVCS = true
+		case "--exclude-vcs-ignores":
+			DoExcludeVCSIgnores = true
+		case "--exclude-caches":
+			DoExcludeCaches = true
+		case "-o", "--output":
+			DstArchive = optionValue()
+		case "--files-from":
+			Files = append(Files, linesArg(arg, optionValue())...)
+		case "--numeric-owner":
+			DoNumericOwner = true
+		case "--owner":
+			Owner = ownerArg(arg, optionValue(), lookupUser)
+		case "--group":
+			Group = ownerArg(arg, optionValue(), lookupGroup)
 		default:
-			if strings.HasPrefix(arg, "--dst-dir=") {
-				DstDir = strings.Replace(arg, "--dst-dir=", "", 1)
-			} else {
-				Files = append(Files, arg)
+			if isOption(arg) {
+				usageError("unknown option %v", arg)
 			}
+			Files = append(Files, arg)
+		}
+	}
+
+	if doUntrusted {
+		setUntrustedLimits()
+	}
+
+	if DstArchive != "" {
+		checkBundle()
+	}
+
+	if DoRecursive {
+		checkRecursive()
+	}
+	if DoRemove {
+		checkRemove()
+	}
+
+	// With -x, the first file is the archive and the rest name its members.
+	if Mode == modeExtract && len(Files) > 1 {
+		Members = Files[1:]
+		Files = Files[:1]
+	}
+	if DoToStdout && Mode != modeExtract {
+		usageError("--to-stdout only works with -x")
+	}
+
+	// Read from stdin if no files were given.
+	if len(Files) == 0 {
+		Files = append(Files, StdioPath)
+	}
+
+	// Data read from stdin is always written to stdout.
+	for _, path := range Files {
+		if path == StdioPath {
+			DoStdout = true
 		}
 	}
+	if DstArchive == StdioPath {
+		DoStdout = true
+	}
 
 	if len(Files) > 1 {
 		DoQuiet = true
 	}
 
+	// Don't mix progress output with data written to stdout.
+	if DoStdout || DoToStdout {
+		DoQuiet = true
+	}
+
 	if DoQuiet {
 		print = printNoop
 	}
@@ -81,11 +334,212 @@ func setGlobalVars() {
 	return
 }
 
+// Set the mode requested by `flag`.
+// Exit if a different mode was already requested.
+func setMode(flag string, m mode) {
+	if conflict := (Mode != modeAuto && Mode != m); conflict {
+		usageError("%v conflicts with a mode set earlier", flag)
+	}
+	Mode = m
+}
+
+// Parse the size given to an option, e.g., "512M".
+func sizeArg(option string, arg string) uint64 {
+	size, err := parseSize(arg)
+	if err != nil {
+		usageError("invalid size for %v: %v", option, arg)
+	}
+	return size
+}
+
+// Parse the positive number given to an option.
+func countArg(option string, arg string) float64 {
+	n, err := strconv.ParseFloat(arg, 64)
+	if err != nil || n <= 0 {
+		usageError("invalid number for %v: %v", option, arg)
+	}
+	return n
+}
+
+// Parse the positive whole number given to an option.
+func intArg(option string, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		usageError("invalid number for %v: %v", option, arg)
+	}
+	return n
+}
+
+// Read the lines of the file given to an option, e.g., patterns or paths.
+// If the file is -, read stdin.
+// Blank lines are skipped.
+func linesArg(option string, arg string) []string {
+
+	var contents []byte
+	var err error
+	if arg == StdioPath {
+		contents, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		contents, err = ioutil.ReadFile(arg)
+	}
+	if err != nil {
+		usageError("cannot read %v for %v", arg, option)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// Make sure -r can be used with the other options given.
+func checkRecursive() {
+
+	switch Mode {
+	case modeAuto, modeCompress, modeDecompress:
+	default:
+		usageError("-r only works when compressing or decompressing")
+	}
+
+	switch {
+	case DoStdout:
+		usageError("-r cannot be used with -c")
+	case DstArchive != "":
+		usageError("-r cannot be used with -o")
+	}
+}
+
+// Make sure --rm can be used with the other options given.
+func checkRemove() {
+
+	switch Mode {
+	case modeAuto, modeCompress, modeDecompress:
+	default:
+		usageError("--rm only works when compressing or decompressing")
+	}
+
+	switch {
+	case DoStdout:
+		usageError("--rm cannot be used with -c")
+	case DstArchive != "":
+		usageError("--rm cannot be used with -o")
+	}
+}
+
+// Make sure the files given can be bundled into a single archive with -o.
+func checkBundle() {
+
+	switch Mode {
+	case modeAuto, modeCompress:
+	default:
+		usageError("-o only works when compressing")
+	}
+
+	if len(Files) == 0 {
+		usageError("-o requires at least one file")
+	}
+
+	for _, path := range Files {
+		if path == StdioPath {
+			usageError("-o cannot bundle stdin")
+		}
+	}
+}
+
+// owner is a user or group to record in tar archives.
+type owner struct {
+	id   int
+	name string
+}
+
+// Parse the user or group given to an option,
+//   as a name, an id, or "name:id" to skip looking it up.
+// `lookup` finds the id and name of a user or group from either one.
+func ownerArg(option string, arg string, lookup func(string) (*owner, error)) *owner {
+
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		id, err := strconv.Atoi(arg[i+1:])
+		if err != nil || id < 0 {
+			usageError("invalid id for %v: %v", option, arg)
+		}
+		return &owner{id: id, name: arg[:i]}
+	}
+
+	o, err := lookup(arg)
+	if err != nil {
+		usageError("unknown name for %v: %v", option, arg)
+	}
+	return o
+}
+
+// Find a user by name or uid.
+// A uid need not belong to any user here.
+func lookupUser(arg string) (*owner, error) {
+
+	if id, err := strconv.Atoi(arg); err == nil && id >= 0 {
+		o := &owner{id: id}
+		if u, err := user.LookupId(arg); err == nil {
+			o.name = u.Username
+		}
+		return o, nil
+	}
+
+	u, err := user.Lookup(arg)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return &owner{id: id, name: u.Username}, nil
+}
+
+// Find a group by name or gid.
+// A gid need not belong to any group here.
+func lookupGroup(arg string) (*owner, error) {
+
+	if id, err := strconv.Atoi(arg); err == nil && id >= 0 {
+		o := &owner{id: id}
+		if g, err := user.LookupGroupId(arg); err == nil {
+			o.name = g.Name
+		}
+		return o, nil
+	}
+
+	g, err := user.LookupGroup(arg)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil, err
+	}
+	return &owner{id: id, name: g.Name}, nil
+}
+
+// Set the maximum number of files processed at once.
+func setJobs(arg string) {
+	jobs, err := strconv.Atoi(arg)
+	if err != nil || jobs < 1 {
+		usageError("invalid number of jobs: %v", arg)
+	}
+	Jobs = jobs
+}
+
+// Check whether an argument looks like an option rather than a file.
+func isOption(arg string) bool {
+	return strings.HasPrefix(arg, "-") && arg != StdioPath
+}
+
 func nextArg(i int) (int, string) {
 	i++
 	if i >= len(os.Args) {
-		printHelp()
-		os.Exit(2)
+		usageError("%v requires an argument", os.Args[i-1])
 	}
 	arg := os.Args[i]
 	return i, arg
@@ -93,141 +547,477 @@ func nextArg(i int) (int, string) {
 
 func main() {
 
-	// if doSingleArchive {
-	// }
+	if helpRequested() {
+		printHelp()
+		os.Exit(exitOK)
+	}
+	setGlobalVars()
+	handleSignals()
 
-	editFiles()
+	os.Exit(editFiles())
 }
 
-func editFiles() {
+// Remove any temporary files and exit if the program is interrupted,
+//   so no partial output is left behind.
+func handleSignals() {
 
-	lenFiles := len(Files)
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, os.Interrupt, syscall.SIGTERM)
 
-	var wg sync.WaitGroup
-	wg.Add(lenFiles)
+	go func() {
+		sig := <-chanSignal
+		removeTemps()
 
-	chanErr := make(chan error, lenFiles)
+		// Exit like a shell would report a process killed by the signal.
+		status := exitFailure
+		if s, ok := sig.(syscall.Signal); ok {
+			status = 128 + int(s)
+		}
+		os.Exit(status)
+	}()
+}
 
-	for _, path := range Files {
-		go func(path string) {
-			defer wg.Done()
-			//path = filepath.Clean(path)
-			dstName, err := compressOrDecompress(path)
-			print(dstName)
-			chanErr <- err
-		}(path)
+// result is the outcome of processing one file.
+type result struct {
+	path    string
+	dstName string
+	err     error
+}
+
+// Process every file with a pool of at most 'Jobs' workers.
+// Results are printed in the same order as 'Files'.
+// Return the exit status.
+func editFiles() int {
+
+	// Bundle every file into a single archive.
+	if DstArchive != "" {
+		dstName, err := tarAndSnapBundle(Files)
+		r := result{DstArchive, dstName, err}
+		printResult(r)
+		return worseStatus(exitOK, r.err)
 	}
 
-	wg.Wait()
-	close(chanErr)
+	status := exitOK
 
-	for err := range chanErr {
-		if err != nil {
-			print(err)
+	// With -r, process every file in the directories given.
+	if DoRecursive {
+		status = expandTrees()
+		if len(Files) > 1 {
+			DoQuiet = true
+			print = printNoop
 		}
 	}
+
+	lenFiles := len(Files)
+
+	// Streams and listings written to stdout must not be interleaved.
+	// Multiple snappy streams written to stdout are concatenated,
+	//   which snappy decoders read as a single stream.
+	jobs := Jobs
+	if DoStdout || DoToStdout || Mode == modeList {
+		jobs = 1
+	}
+	if jobs > lenFiles {
+		jobs = lenFiles
+	}
+
+	// Give each file its own channel so results can be read in order.
+	chanResults := make([]chan result, lenFiles)
+	for i := range chanResults {
+		chanResults[i] = make(chan result, 1)
+	}
+
+	chanIndexes := make(chan int)
+	go func() {
+		for i := range Files {
+			chanIndexes <- i
+		}
+		close(chanIndexes)
+	}()
+
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for i := range chanIndexes {
+				path := Files[i]
+				dstName, err := compressOrDecompress(path)
+				chanResults[i] <- result{path, dstName, err}
+			}
+		}()
+	}
+
+	for _, chanResult := range chanResults {
+		r := <-chanResult
+		printResult(r)
+		status = worseStatus(status, r.err)
+	}
+
+	return status
+}
+
+// Return the exit status for a run which has `status` so far
+//   and has just finished a file with `err`.
+// A corrupt file outranks any other failure.
+func worseStatus(status int, err error) int {
+	switch {
+	case err == nil:
+		return status
+	case isCorrupt(err):
+		return exitCorrupt
+	case status == exitCorrupt:
+		return status
+	}
+	return exitFailure
 }
 
 // Determine whether a file should be compressed, uncompressed, or
 //   added to a tar archive and then compressed.
 func compressOrDecompress(path string) (string, error) {
 
+	switch Mode {
+	case modeTest:
+		return verify(path)
+	case modeList:
+		return list(path)
+	case modeExtract:
+		return extract(path)
+	}
+
+	if path == StdioPath {
+		return StdioPath, compressOrDecompressStream(os.Stdout, os.Stdin, path)
+	}
+
 	src, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer src.Close()
 
+	if DoStdout {
+		return StdioPath, compressOrDecompressToStdout(src)
+	}
+
+	// Get file info before reading changes the access time.
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Sniff the file's signature without losing the bytes read.
+	r, srcIsSz := sniffSz(src)
+
+	// With -r, leave alone files which don't need to be processed.
+	if isTreeFile(path) && skipTreeFile(r, srcIsSz) {
+		return "", nil
+	}
+
+	if err := checkMode(path, srcIsSz); err != nil {
+		return "", err
+	}
+
 	var dstName string
 
 	switch {
 
-	// If `src` is a snappy file, uncompress it.
-	case isSz(src):
-		dstName, err = unsnapAndUntar(src)
+	// If `src` is a snappy file, uncompress it,
+	//   unless the user asked to compress it again.
+	case srcIsSz && Mode != modeCompress:
+		dstName, err = unsnapAndUntar(src, srcInfo, r)
 
-	// If `src` is a directory, tar it before compressing it.
-	// (Simultaneously compressing and tarring the file
-	//   results in a much lower compression ratio.)
+	// If `src` is a directory, tar it and compress it.
 	case isDir(src):
 		dstName, err = tarAndSnap(src)
 
 	// If `src` is any other type, compress it.
 	default:
-		dstName, err = snap(src)
+		dstName, err = snapFile(src, srcInfo, r)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	return dstName, err
+	// With --rm, remove the source now that its output is safe.
+	return dstName, removeSource(path, srcInfo, dstName)
 }
 
-// Uncompress a file.
-// Then, if the uncompressed file is a tar archive, extract it as well.
-func unsnapAndUntar(src *os.File) (string, error) {
+// Compress or uncompress a named file and write the result to stdout.
+func compressOrDecompressToStdout(src *os.File) error {
+
+	srcName := src.Name()
+
+	if isDir(src) {
+		if err := checkMode(srcName, false); err != nil {
+			return err
+		}
+		return tarDir(os.Stdout, srcName, StdioPath, nil)
+	}
+
+	return compressOrDecompressStream(os.Stdout, src, srcName)
+}
+
+// Determine whether a stream should be compressed or uncompressed,
+//   then write the result to `dst`.
+// `srcName` is only used in error messages.
+func compressOrDecompressStream(dst io.Writer, src *os.File, srcName string) error {
+
+	r, srcIsSz := sniffSz(src)
+	if err := checkMode(srcName, srcIsSz); err != nil {
+		return err
+	}
+
+	if srcIsSz && Mode != modeCompress {
+		_, err := unsnap(dst, r)
+		return err
+	}
+
+	// Store the metadata of a named file.
+	var metadata *fileMetadata
+	if srcInfo, err := src.Stat(); err == nil {
+		metadata = newFileMetadata(src, srcInfo)
+	}
+
+	_, err := snap(dst, r, metadata)
+	return err
+}
+
+// Check the integrity of a snappy archive without writing anything.
+// Return an error describing any corruption.
+func verify(path string) (string, error) {
+
+	src, err := openPath(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	r, srcIsSz := sniffSz(src)
+	if err := checkMode(path, srcIsSz); err != nil {
+		return "", err
+	}
+
+	return "", verifySz(r)
+}
 
-	// Uncompress it.
-	unsnappedName, err := unsnap(src)
+// Print every entry of a compressed tar archive without extracting anything.
+func list(path string) (string, error) {
+
+	src, err := openPath(path)
 	if err != nil {
 		return "", err
 	}
+	defer src.Close()
+
+	r, srcIsSz := sniffSz(src)
+	if err := checkMode(path, srcIsSz); err != nil {
+		return "", err
+	}
+
+	// With a seek table, skip over the contents of members
+	//   instead of decoding them.
+	if seekable, ok := openSeekable(src, nil); ok {
+		if !isTarAt(seekable) {
+			return "", fmt.Errorf("not a tar archive")
+		}
+		return "", listTar(path, seekable)
+	}
+
+	szr := newParallelReader(r, runtime.GOMAXPROCS(0))
+	defer szr.Close()
+
+	unsnapped, unsnappedIsTar := sniffTar(szr)
+	if !unsnappedIsTar {
+		return "", fmt.Errorf("not a tar archive")
+	}
+
+	return "", listTar(path, unsnapped)
+}
+
+// Extract the members of a compressed tar archive
+//   which match the patterns given after it, or every member if none were.
+// With --to-stdout, write their contents to stdout instead.
+// Only as much of the archive is read as is needed.
+func extract(path string) (string, error) {
 
-	unsnapped, err := os.Open(unsnappedName)
+	src, err := openPath(path)
 	if err != nil {
 		return "", err
 	}
-	defer unsnapped.Close()
+	defer src.Close()
 
-	// If `unsnapped` is not a tar archive, we are done.
-	if done := !isTar(unsnapped); done {
-		return unsnappedName, nil
+	r, srcIsSz := sniffSz(src)
+	if err := checkMode(path, srcIsSz); err != nil {
+		return "", err
 	}
 
-	// Remove the temporary tar archive if nothing dies.
-	defer func() {
-		if err != nil {
-			return
+	// Stop extracting once the archive passes any limit.
+	guard := &bombGuard{}
+
+	// With a seek table, skip over the contents of members
+	//   which aren't wanted instead of decoding them.
+	var unsnapped io.Reader
+	if seekable, ok := openSeekable(src, guard); ok {
+		if !isTarAt(seekable) {
+			return "", fmt.Errorf("not a tar archive")
 		}
-		os.Remove(unsnappedName)
-	}()
+		unsnapped = guard.countOutSeeker(seekable)
+	} else {
+		szr := newParallelReader(guard.countIn(r), runtime.GOMAXPROCS(0))
+		defer szr.Close()
+
+		br, unsnappedIsTar := sniffTar(guard.countOut(szr))
+		if !unsnappedIsTar {
+			return "", fmt.Errorf("not a tar archive")
+		}
+		unsnapped = br
+	}
+
+	var members *memberMatcher
+	if len(Members) != 0 {
+		members = newMemberMatcher(Members)
+	}
 
-	dstName, err := untar(unsnapped)
+	if DoToStdout {
+		if err := catMembers(os.Stdout, unsnapped, guard, members); err != nil {
+			return "", err
+		}
+		if members != nil {
+			return "", members.notFound()
+		}
+		return "", nil
+	}
+
+	dstName, err := untarMembers(path, unsnapped, guard, members)
 	if err != nil {
 		return "", err
 	}
+	if members != nil {
+		if err := members.notFound(); err != nil {
+			return "", fmt.Errorf("extracted to %v, but %v", dstName, err)
+		}
+	}
 
 	return dstName, nil
 }
 
-// Make a temporary tar archive of a file and then compress it.
-// (Simultaneously compressing and tarring the file
-//  results in a much lower compression ratio.)
-// Remove the temporary tar archive if no errors occur.
+// Make sure a source matches the mode requested by the user.
+func checkMode(srcName string, srcIsSz bool) error {
+
+	switch Mode {
+	case modeAuto, modeCompress:
+		return nil
+	}
+
+	if !srcIsSz {
+		return fmt.Errorf("not a snappy archive")
+	}
+
+	return nil
+}
+
+// Uncompress a file.
+// Then, if the uncompressed data is a tar archive, extract it as well.
+// Both happen in a single pass, so no temporary tar archive is created.
+// `r` reads the contents of `src`, and `srcInfo` describes it.
+func unsnapAndUntar(src *os.File, srcInfo os.FileInfo, r io.Reader) (string, error) {
+
+	// Set up a *passthru reader in order to print progress.
+	// Progress is not printed until the destination name is known.
+	pt := &passthru{Reader: r}
+	defer pt.Reset()
+
+	// Stop extracting once the archive passes any limit.
+	guard := &bombGuard{}
+
+	// Uncompress it, and check whether the result is a tar archive.
+	szr := newParallelReader(guard.countIn(pt), runtime.GOMAXPROCS(0))
+	defer szr.Close()
+	unsnapped, unsnappedIsTar := sniffTar(guard.countOut(szr))
+
+	// If the archive describes the original file,
+	//   show progress against the original file's size instead.
+	metadata := szr.Metadata()
+	if metadata == nil || unsnappedIsTar && !isTreeFile(src.Name()) {
+		pt.nExpected = uint64(srcInfo.Size())
+	}
+	defer print()
+
+	// If `unsnapped` is a tar archive, extract it,
+	//   unless -r asked for each file to be decompressed on its own.
+	if unsnappedIsTar && !isTreeFile(src.Name()) {
+		return untar(src.Name(), unsnapped, guard)
+	}
+
+	if metadata == nil {
+		return unsnapFile(src.Name(), srcInfo, nil, guard.countFile(unsnapped))
+	}
+
+	ptOut := &passthru{Reader: unsnapped, nExpected: metadata.size}
+	defer ptOut.Reset()
+
+	return unsnapFile(src.Name(), srcInfo, metadata, guard.countFile(ptOut))
+}
+
+// Tar files and directories into a single archive and compress it,
+//   keeping the paths they were given by.
+// The archive is named by -o; if that is -, it is written to stdout.
+func tarAndSnapBundle(srcNames []string) (string, error) {
+
+	if DstArchive == StdioPath {
+		return "", tarFiles(os.Stdout, srcNames, StdioPath, nil)
+	}
+
+	return writeArchive(DstArchive, 0644, func(dst io.Writer, h hash.Hash) error {
+		return tarFiles(dst, srcNames, DstArchive, h)
+	})
+}
+
+// Tar a directory and compress it.
+// Both happen in a single pass, so no temporary tar archive is created.
 func tarAndSnap(src *os.File) (string, error) {
 
-	// Tar it.
-	tarredName, err := tarDir(src)
+	srcInfo, err := src.Stat()
 	if err != nil {
 		return "", err
 	}
 
-	tarred, err := os.Open(tarredName)
+	srcName := src.Name()
+	baseName := filepath.Base(srcName)
+
+	dstName := concat(baseName, ".tar.sz")
+	setDstName(&dstName)
+
+	return writeArchive(dstName, srcInfo.Mode(), func(dst io.Writer, h hash.Hash) error {
+		return tarDir(dst, srcName, dstName, h)
+	})
+}
+
+// Write a new compressed tar archive named `dstName` with `write`,
+//   which is also given a hash of the archive to fill in with --verify.
+// The archive is written under a temporary name, checked against
+//   the hash, and moved into place only once it is complete.
+// Return the name it was moved to.
+func writeArchive(dstName string, mode os.FileMode, write func(dst io.Writer, h hash.Hash) error) (string, error) {
+
+	// Create the destination file under a temporary name.
+	dst, err := createPending(dstName, mode)
 	if err != nil {
 		return "", err
 	}
-	defer tarred.Close()
+	defer dst.abort()
 
-	// Remove the temporary tar archive if nothing dies.
-	defer func() {
-		if err != nil {
-			return
-		}
-		os.Remove(tarredName)
-	}()
+	// With --verify, hash the archive to check the new file against.
+	h := newVerifyHash()
+	if err := write(dst, h); err != nil {
+		return "", err
+	}
 
-	// Compress it.
-	dstName, err := snap(tarred)
-	if err != nil {
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	if err := verifyOutput(dst.Name(), h, true); err != nil {
 		return "", err
 	}
 
-	return dstName, nil
+	// Move the finished archive into place.
+	// Make sure existing files are not overwritten.
+	return dst.commit()
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/golang/snappy"
 )
 
 var (
@@ -38,6 +42,11 @@ func TestSnap(t *testing.T) {
 	sumName := nameRegSnapped
 	sumExpected := sumRegSnapped
 
+	// Metadata holds the file's mtime, which differs between checkouts,
+	//   so leave it out to keep the archive's checksum the same.
+	DoMetadata = false
+	defer func() { DoMetadata = true }()
+
 	t.Run("snap", func(t *testing.T) {
 		dstName, err := compressOrDecompress(srcName)
 		if err != nil {
@@ -187,3 +196,174 @@ func sha256sum(path string) (string, error) {
 
 	return sum, nil
 }
+
+// Write `contents` to a new temporary file and open it for reading.
+func tempFileWith(t *testing.T, dir string, name string, contents []byte) *os.File {
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// TestCompressOrDecompressStream tests that a stream compressed
+//   to stdout decompresses back to its input.
+func TestCompressOrDecompressStream(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := framingTestData(3*SnappyMaxUncompressedChunkLen + 5)
+
+	src := tempFileWith(t, root, "data", data)
+	defer src.Close()
+
+	var snapped bytes.Buffer
+	if err := compressOrDecompressStream(&snapped, src, src.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(snapped.Bytes(), snappySignature) {
+		t.Fatal("Expected the output to be a snappy stream.")
+	}
+
+	sz := tempFileWith(t, root, "data.sz", snapped.Bytes())
+	defer sz.Close()
+
+	var unsnapped bytes.Buffer
+	if err := compressOrDecompressStream(&unsnapped, sz, sz.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsnapped.Bytes(), data) {
+		t.Error("Expected the stream to decompress to its input.")
+	}
+}
+
+// TestCheckMode tests that -d refuses input which is not a snappy archive
+//   and writes nothing, while other modes accept it.
+func TestCheckMode(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(m mode) { Mode = m }(Mode)
+
+	for _, m := range []mode{modeAuto, modeCompress} {
+		Mode = m
+		if err := checkMode("data", false); err != nil {
+			t.Errorf("Expected mode %v to accept any input but got %v.\n", m, err)
+		}
+	}
+
+	Mode = modeDecompress
+	if err := checkMode("data", true); err != nil {
+		t.Errorf("Expected -d to accept a snappy archive but got %v.\n", err)
+	}
+
+	src := tempFileWith(t, root, "data", []byte("not a snappy archive"))
+	defer src.Close()
+
+	var dst bytes.Buffer
+	if err := compressOrDecompressStream(&dst, src, src.Name()); err == nil {
+		t.Error("Expected -d to refuse input which is not a snappy archive.")
+	}
+	if dst.Len() != 0 {
+		t.Errorf("Expected no output but got %v bytes.\n", dst.Len())
+	}
+}
+
+// TestWorseStatus tests that a corrupt file outranks any other failure
+//   in the exit status, whichever comes first.
+func TestWorseStatus(t *testing.T) {
+
+	errCorrupt := snappy.ErrCorrupt
+	errFailure := os.ErrNotExist
+
+	for _, err := range []error{snappy.ErrCorrupt, io.ErrUnexpectedEOF, errSizeMismatch, errDigestMismatch} {
+		if !isCorrupt(err) {
+			t.Errorf("Expected %v to be corrupt.\n", err)
+		}
+	}
+	for _, err := range []error{errFailure, &limitError{"--max-output", "1M"}} {
+		if isCorrupt(err) {
+			t.Errorf("Expected %v not to be corrupt.\n", err)
+		}
+	}
+
+	runs := []struct {
+		errs   []error
+		status int
+	}{
+		{[]error{nil, nil}, exitOK},
+		{[]error{nil, errFailure, nil}, exitFailure},
+		{[]error{errCorrupt, nil}, exitCorrupt},
+		{[]error{errFailure, errCorrupt}, exitCorrupt},
+		{[]error{errCorrupt, errFailure}, exitCorrupt},
+	}
+
+	for _, run := range runs {
+		status := exitOK
+		for _, err := range run.errs {
+			status = worseStatus(status, err)
+		}
+		if status != run.status {
+			t.Errorf("Expected exit status %v for %v but got %v.\n", run.status, run.errs, status)
+		}
+	}
+}
+
+// TestEditFilesOrder tests that with several jobs, results are printed
+//   in the order the files were given, however long each one takes.
+func TestEditFilesOrder(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(m mode, jobs int, files []string) {
+		Mode, Jobs, Files, report = m, jobs, files, fmt.Println
+	}(Mode, Jobs, Files)
+
+	// Larger files take longer to verify than the ones after them.
+	var files []string
+	for i, size := range []int{8, 4, 2, 1, 0} {
+		data := framingTestData(size*SnappyMaxUncompressedChunkLen + 1)
+		src := tempFileWith(t, root, fmt.Sprintf("%v.sz", i), snapTestStream(t, data))
+		src.Close()
+		files = append(files, src.Name())
+	}
+
+	var reported []string
+	report = func(x ...interface{}) (int, error) {
+		reported = append(reported, fmt.Sprint(x...))
+		return 0, nil
+	}
+
+	Mode, Jobs, Files = modeTest, 4, files
+	if status := editFiles(); status != exitOK {
+		t.Fatalf("Expected exit status %v but got %v.\n", exitOK, status)
+	}
+
+	if len(reported) != len(files) {
+		t.Fatalf("Expected %v results but got %v.\n", len(files), len(reported))
+	}
+	for i, path := range files {
+		if expected := concat(path, ": OK"); reported[i] != expected {
+			t.Errorf("Expected result %v to be %q but got %q.\n", i, expected, reported[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// memberMatcher picks the members of a tar archive to extract
+//   with -x, and keeps track of which patterns have matched.
+type memberMatcher struct {
+	patterns []string
+	// Whether each pattern has matched any member.
+	matched []bool
+	// Whether each pattern names a single file which has been found.
+	// Once all have been, the rest of the archive need not be read.
+	found []bool
+}
+
+// Return a *memberMatcher for the patterns given after the archive.
+func newMemberMatcher(patterns []string) *memberMatcher {
+
+	m := &memberMatcher{
+		patterns: make([]string, len(patterns)),
+		matched:  make([]bool, len(patterns)),
+		found:    make([]bool, len(patterns)),
+	}
+
+	for i, pattern := range patterns {
+		m.patterns[i] = cleanMemberName(pattern)
+	}
+
+	return m
+}
+
+// Check whether a member should be extracted.
+// A pattern matches a member's name, e.g., "conf/*.yaml",
+//   or the name of a directory it is in, e.g., "conf".
+func (m *memberMatcher) match(hdr *tar.Header) bool {
+
+	name := cleanMemberName(hdr.Name)
+	isMatch := false
+
+	for i, pattern := range m.patterns {
+		if !matchMember(pattern, name) {
+			continue
+		}
+		isMatch = true
+		m.matched[i] = true
+
+		// A directory's contents follow it, so it isn't found yet.
+		if !isGlob(pattern) && pattern == name && hdr.Typeflag != tar.TypeDir {
+			m.found[i] = true
+		}
+	}
+
+	return isMatch
+}
+
+// Check whether every pattern names a single file which has been found.
+func (m *memberMatcher) done() bool {
+	for _, found := range m.found {
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Return an error listing the patterns which matched nothing,
+//   or nil if every one matched.
+func (m *memberMatcher) notFound() error {
+
+	var missing []string
+	for i, pattern := range m.patterns {
+		if !m.matched[i] {
+			missing = append(missing, pattern)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("not found in archive: %v", strings.Join(missing, ", "))
+}
+
+// Check whether a pattern matches a member's name
+//   or the name of any directory it is in.
+func matchMember(pattern string, name string) bool {
+	for {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// Remove the parts of a member name which don't affect where it goes,
+//   i.e., a leading "./" and a trailing "/".
+func cleanMemberName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+}
+
+// Check whether a pattern has any special characters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+// TestMemberMatcher tests picking members to extract with -x.
+func TestMemberMatcher(t *testing.T) {
+
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"conf/app.yaml", "conf/app.yaml", true},
+		{"conf/app.yaml", "./conf/app.yaml", true},
+		{"conf/*.yaml", "conf/app.yaml", true},
+		{"conf/*.yaml", "conf/sub/app.yaml", false},
+		{"conf/*.yaml", "conf/app.txt", false},
+		{"conf", "conf/", true},
+		{"conf/", "conf/sub/app.yaml", true},
+		{"conf", "config/app.yaml", false},
+		{"*/app.yaml", "conf/app.yaml", true},
+	}
+
+	for _, test := range tests {
+		m := newMemberMatcher([]string{test.pattern})
+		if matched := m.match(&tar.Header{Name: test.name}); matched != test.expected {
+			t.Errorf("Expected %q matching %q to be %v but got %v.\n",
+				test.pattern, test.name, test.expected, matched)
+		}
+	}
+}
+
+// TestMemberMatcherDone tests that reading stops only once every member
+//   requested by name has been found,
+//   and that patterns which matched nothing are reported.
+func TestMemberMatcherDone(t *testing.T) {
+
+	m := newMemberMatcher([]string{"conf", "README", "missing"})
+
+	m.match(&tar.Header{Name: "conf/", Typeflag: tar.TypeDir})
+	m.match(&tar.Header{Name: "README", Typeflag: tar.TypeReg})
+	if m.done() {
+		t.Errorf("Expected a directory and a missing member not to be done.\n")
+	}
+
+	err := m.notFound()
+	if err == nil || err.Error() != "not found in archive: missing" {
+		t.Errorf("Expected only \"missing\" not to be found but got %v.\n", err)
+	}
+
+	m = newMemberMatcher([]string{"./a", "b/"})
+	m.match(&tar.Header{Name: "a", Typeflag: tar.TypeReg})
+	if m.done() {
+		t.Errorf("Expected b not to be found yet.\n")
+	}
+	m.match(&tar.Header{Name: "b", Typeflag: tar.TypeReg})
+	if !m.done() {
+		t.Errorf("Expected a and b to be found.\n")
+	}
+	if err := m.notFound(); err != nil {
+		t.Errorf("Expected every member to be found but got %v.\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Metadata about the original file is stored in skippable chunks,
+//   which standard snappy decoders ignore.
+// A metadata chunk follows the stream identifier:
+//   metadataMagic (4 bytes), flags (1 byte), size (8 bytes),
+//   mtime in nanoseconds since the Unix epoch (8 bytes),
+//   mode (4 bytes), and the file's name (the rest of the chunk)
+// If its flags include metadataHasDigest, a digest chunk follows
+//   the last data chunk:
+//   digestMagic (4 bytes), SHA-256 of the original file (32 bytes)
+// All numbers are little-endian.
+const (
+	chunkTypeMetadata = 0x98
+	chunkTypeDigest   = 0x97
+	metadataMagic     = "szmd"
+	digestMagic       = "szsh"
+	metadataLen       = 4 + 1 + 8 + 8 + 4
+	metadataHasDigest = 0x01
+)
+
+var (
+	errSizeMismatch   = errors.New("size does not match the original file")
+	errDigestMismatch = errors.New("SHA-256 digest does not match the original file")
+	errDigestMissing  = errors.New("SHA-256 digest is missing")
+)
+
+// fileMetadata describes the original file compressed into a stream.
+type fileMetadata struct {
+	name    string
+	size    uint64
+	modTime time.Time
+	mode    os.FileMode
+	// Whether a SHA-256 digest of the contents follows them.
+	hasDigest bool
+}
+
+// Return the metadata to store when compressing a file,
+//   or nil if the file is stdin or not a regular file.
+// With -n, store nothing, or only the size if a digest follows.
+func newFileMetadata(src *os.File, srcInfo os.FileInfo) *fileMetadata {
+
+	if src == os.Stdin || !srcInfo.Mode().IsRegular() || !DoMetadata && !DoDigest {
+		return nil
+	}
+
+	if !DoMetadata {
+		return &fileMetadata{
+			size:      uint64(srcInfo.Size()),
+			modTime:   time.Unix(0, 0),
+			hasDigest: true,
+		}
+	}
+
+	return &fileMetadata{
+		name:      filepath.Base(src.Name()),
+		size:      uint64(srcInfo.Size()),
+		modTime:   srcInfo.ModTime(),
+		mode:      srcInfo.Mode(),
+		hasDigest: DoDigest,
+	}
+}
+
+// Encode a skippable chunk, header and all.
+func encodeSkippableChunk(chunkType byte, body []byte) []byte {
+
+	chunkLen := len(body)
+	chunk := make([]byte, chunkHeaderLen, chunkHeaderLen+chunkLen)
+	chunk[0] = chunkType
+	chunk[1] = uint8(chunkLen >> 0)
+	chunk[2] = uint8(chunkLen >> 8)
+	chunk[3] = uint8(chunkLen >> 16)
+
+	return append(chunk, body...)
+}
+
+// Encode a metadata chunk.
+func encodeMetadata(m *fileMetadata) []byte {
+
+	body := make([]byte, metadataLen, metadataLen+len(m.name))
+	copy(body, metadataMagic)
+	if m.hasDigest {
+		body[4] |= metadataHasDigest
+	}
+	binary.LittleEndian.PutUint64(body[5:], m.size)
+	binary.LittleEndian.PutUint64(body[13:], uint64(m.modTime.UnixNano()))
+	binary.LittleEndian.PutUint32(body[21:], uint32(m.mode))
+	body = append(body, m.name...)
+
+	return encodeSkippableChunk(chunkTypeMetadata, body)
+}
+
+// Decode the body of a metadata chunk.
+// Return nil if the chunk was not written by this program.
+func decodeMetadata(body []byte) *fileMetadata {
+
+	if len(body) < metadataLen || string(body[:4]) != metadataMagic {
+		return nil
+	}
+
+	return &fileMetadata{
+		name:      string(body[metadataLen:]),
+		size:      binary.LittleEndian.Uint64(body[5:]),
+		modTime:   time.Unix(0, int64(binary.LittleEndian.Uint64(body[13:]))),
+		mode:      os.FileMode(binary.LittleEndian.Uint32(body[21:])),
+		hasDigest: body[4]&metadataHasDigest != 0,
+	}
+}
+
+// Encode a digest chunk.
+func encodeDigest(sum []byte) []byte {
+	return encodeSkippableChunk(chunkTypeDigest, append([]byte(digestMagic), sum...))
+}
+
+// Return the name a file decompressed from a stream with metadata `m`
+//   should be given, or "" if the name stored is not safe to use.
+func (m *fileMetadata) fileName() string {
+
+	name := m.name
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return ""
+	}
+
+	return name
+}
+
+// metadataInfo describes a file as its metadata does,
+//   so that preserve gives the decompressed file the original
+//   file's permissions and timestamps.
+type metadataInfo struct {
+	os.FileInfo
+	m *fileMetadata
+}
+
+func (fi metadataInfo) Mode() os.FileMode  { return fi.m.mode }
+func (fi metadataInfo) ModTime() time.Time { return fi.m.modTime }
+
+// streamCheck checks the data decoded from a stream
+//   against the stream's metadata, if it has any.
+type streamCheck struct {
+	metadata *fileMetadata
+	n        uint64
+	digest   hash.Hash
+}
+
+// Start checking the data which follows metadata `m`.
+func (c *streamCheck) start(m *fileMetadata) {
+	*c = streamCheck{metadata: m}
+	if m.hasDigest {
+		c.digest = sha256.New()
+	}
+}
+
+// Count, and hash if needed, a block of decoded data.
+func (c *streamCheck) write(block []byte) {
+	if c.metadata == nil {
+		return
+	}
+	c.n += uint64(len(block))
+	if c.digest != nil {
+		c.digest.Write(block)
+	}
+}
+
+// Compare the body of a digest chunk with the digest of the data.
+func (c *streamCheck) checkDigest(body []byte) error {
+
+	if c.digest == nil || len(body) < len(digestMagic) || string(body[:len(digestMagic)]) != digestMagic {
+		return nil
+	}
+
+	if !bytes.Equal(body[len(digestMagic):], c.digest.Sum(nil)) {
+		return errDigestMismatch
+	}
+	c.digest = nil
+
+	return nil
+}
+
+// Finish checking at the end of a stream.
+func (c *streamCheck) end() error {
+
+	m, n, digest := c.metadata, c.n, c.digest
+	*c = streamCheck{}
+
+	switch {
+	case m == nil:
+		return nil
+	case n != m.size:
+		return errSizeMismatch
+	case digest != nil:
+		return errDigestMissing
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// TestMetadata tests that metadata stored in a stream is read back,
+//   that the data is checked against it,
+//   and that *snappy.Reader still reads the stream.
+func TestMetadata(t *testing.T) {
+
+	data := framingTestData(2*SnappyMaxUncompressedChunkLen + 77)
+	metadata := &fileMetadata{
+		name:      "data.bin",
+		size:      uint64(len(data)),
+		modTime:   time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		mode:      0640,
+		hasDigest: true,
+	}
+
+	var sz bytes.Buffer
+	if _, err := snap(&sz, bytes.NewReader(data), metadata); err != nil {
+		t.Fatal(err)
+	}
+	stream := sz.Bytes()
+
+	unsnapped, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsnapped, data) {
+		t.Error("Expected *snappy.Reader to decode the stream to its input.")
+	}
+
+	szr := newParallelReader(bytes.NewReader(stream), 4)
+	defer szr.Close()
+	if _, err := ioutil.ReadAll(szr); err != nil {
+		t.Fatal(err)
+	}
+	m := szr.Metadata()
+	if m == nil || m.name != metadata.name || m.size != metadata.size ||
+		!m.modTime.Equal(metadata.modTime) || m.mode != metadata.mode || !m.hasDigest {
+		t.Errorf("Expected metadata %+v but got %+v.\n", metadata, m)
+	}
+
+	// The digest chunk holds the last bytes of the stream.
+	wrongDigest := append([]byte{}, stream...)
+	wrongDigest[len(wrongDigest)-1] ^= 1
+
+	noDigest := stream[:len(stream)-len(encodeDigest(make([]byte, sha256.Size)))]
+
+	// Claim the data is a byte longer than it is.
+	var wrongSize bytes.Buffer
+	pw := newParallelWriter(&wrongSize, 4)
+	pw.writeChunk(encodeMetadata(&fileMetadata{size: uint64(len(data) + 1)}))
+	if _, err := pw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	streams := map[string]struct {
+		stream   []byte
+		expected error
+	}{
+		"wrong digest": {wrongDigest, errDigestMismatch},
+		"no digest":    {noDigest, errDigestMissing},
+		"wrong size":   {wrongSize.Bytes(), errSizeMismatch},
+	}
+
+	for name, test := range streams {
+		szr := newParallelReader(bytes.NewReader(test.stream), 4)
+		if _, err := ioutil.ReadAll(szr); err != test.expected {
+			t.Errorf("Expected %v stream to fail with %q but got %v.\n", name, test.expected, err)
+		}
+		szr.Close()
+	}
+}
+
+// TestMetadataFileName tests that only plain file names are restored.
+func TestMetadataFileName(t *testing.T) {
+
+	names := map[string]string{
+		"data.bin":      "data.bin",
+		"":              "",
+		".":             "",
+		"..":            "",
+		"../etc/passwd": "",
+		"/etc/passwd":   "",
+	}
+
+	for name, expected := range names {
+		m := &fileMetadata{name: name, mode: os.FileMode(0644)}
+		if got := m.fileName(); got != expected {
+			t.Errorf("Expected %q to be restored as %q but got %q.\n", name, expected, got)
+		}
+	}
+}
+
+// TestNewFileMetadata tests that metadata is stored by default,
+//   that -n leaves it out, and that --sha256 adds a digest.
+func TestNewFileMetadata(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func() { DoMetadata, DoDigest = true, false }()
+
+	src := tempFileWith(t, root, "data.bin", []byte("data"))
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DoMetadata, DoDigest = true, false
+	m := newFileMetadata(src, srcInfo)
+	if m == nil || m.name != "data.bin" || m.size != 4 || !m.modTime.Equal(srcInfo.ModTime()) ||
+		m.mode != srcInfo.Mode() || m.hasDigest {
+		t.Errorf("Expected metadata of %v by default but got %+v.\n", src.Name(), m)
+	}
+
+	DoMetadata, DoDigest = true, true
+	if m := newFileMetadata(src, srcInfo); m == nil || !m.hasDigest {
+		t.Errorf("Expected --sha256 to add a digest but got %+v.\n", m)
+	}
+
+	DoMetadata, DoDigest = false, false
+	if m := newFileMetadata(src, srcInfo); m != nil {
+		t.Errorf("Expected -n to store no metadata but got %+v.\n", m)
+	}
+
+	DoMetadata, DoDigest = false, true
+	if m := newFileMetadata(src, srcInfo); m == nil || m.fileName() != "" || m.size != 4 || !m.hasDigest {
+		t.Errorf("Expected -n --sha256 to store only the size and digest but got %+v.\n", m)
+	}
+
+	DoMetadata, DoDigest = true, false
+	if m := newFileMetadata(os.Stdin, srcInfo); m != nil {
+		t.Errorf("Expected no metadata for stdin but got %+v.\n", m)
+	}
+}
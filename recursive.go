@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// treeDstDirs maps each file found by -r to the directory
+//   its output is placed in.
+// It is filled in before any file is processed and only read after.
+var treeDstDirs = make(map[string]string)
+
+// Signatures of compressed formats, skipped by --skip-compressed.
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	[]byte("BZh"),                      // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	[]byte("PK\x03\x04"),               // zip
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("Rar!\x1a\x07"),             // rar
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{0x89, 'P', 'N', 'G', '\r', '\n'},  // png
+}
+
+// Replace each directory in 'Files' with every regular file in it,
+//   except for any the user asked to exclude or skip,
+//   and choose where the output for each one goes.
+// Files given by name are kept, and their output placed as with -r.
+// Return the exit status for any directory which couldn't be read.
+func expandTrees() int {
+
+	status := exitOK
+	var files []string
+
+	for _, root := range Files {
+		if root == StdioPath {
+			files = append(files, root)
+			continue
+		}
+
+		walker := newExcluder(root, filepath.Base(root))
+		err := walker.walk(func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				printError(path, err)
+				status = worseStatus(status, err)
+				return nil
+			}
+			if !fi.Mode().IsRegular() || skipSize(fi) {
+				return nil
+			}
+
+			dir, err := treeDstDir(root, path)
+			if err != nil {
+				return err
+			}
+			treeDstDirs[path] = dir
+			files = append(files, path)
+
+			return nil
+		})
+		if err != nil {
+			printError(root, err)
+			status = worseStatus(status, err)
+		}
+	}
+
+	Files = files
+
+	return status
+}
+
+// Return the directory in which to place the output for `path`,
+//   a file found under `root`.
+// That is the file's own directory, or with --dst-dir,
+//   the directory under 'DstDir' at the same place as the file's is
+//   under `root`.
+func treeDstDir(root string, path string) (string, error) {
+
+	dir := filepath.Dir(path)
+	if DstDir == "" {
+		return dir, nil
+	}
+
+	if path == root {
+		return DstDir, nil
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(DstDir, rel), nil
+}
+
+// Check whether a file is too small to be worth compressing.
+func skipSize(fi os.FileInfo) bool {
+	return Mode != modeDecompress && uint64(fi.Size()) < MinSize
+}
+
+// Check whether a file found by -r should be left alone:
+//   when decompressing, any file which is not a snappy archive,
+//   and when compressing, snappy archives unless -z was given,
+//   and, with --skip-compressed, files in other compressed formats.
+func skipTreeFile(br *bufio.Reader, srcIsSz bool) bool {
+
+	switch {
+	case Mode == modeDecompress:
+		return !srcIsSz
+	case Mode == modeAuto && srcIsSz:
+		return true
+	case DoSkipCompressed:
+		return isCompressed(br)
+	}
+
+	return false
+}
+
+// Check a buffered stream's contents for the signature
+//   of a compressed format.
+// The signature is peeked at, so no data is consumed from the stream.
+func isCompressed(br *bufio.Reader) bool {
+
+	for _, signature := range compressedSignatures {
+		chunk, err := br.Peek(len(signature))
+		if err == nil && bytes.Equal(chunk, signature) {
+			return true
+		}
+	}
+
+	return isSz(br)
+}
+
+// Check whether a file was found by -r.
+func isTreeFile(path string) bool {
+	_, ok := treeDstDirs[path]
+	return ok
+}
+
+// Place the output for a file found by -r in the directory chosen for it,
+//   or else under 'DstDir' if the user set one.
+// Create the directory if need be.
+func setTreeDstName(srcName string, dstName *string) error {
+
+	dir, ok := treeDstDirs[srcName]
+	if !ok {
+		setDstName(dstName)
+		return nil
+	}
+
+	*dstName = filepath.Join(dir, filepath.Base(*dstName))
+
+	return os.MkdirAll(dir, 0755)
+}
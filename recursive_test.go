@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestTreeDstDir tests where -r places the output for each file.
+func TestTreeDstDir(t *testing.T) {
+
+	defer func() { DstDir = "" }()
+
+	tests := []struct {
+		dstDir   string
+		root     string
+		path     string
+		expected string
+	}{
+		{"", "logs", "logs/app/a.log", "logs/app"},
+		{"", "logs/a.log", "logs/a.log", "logs"},
+		{"out", "logs", "logs/a.log", "out"},
+		{"out", "logs", "logs/app/old/a.log", "out/app/old"},
+		{"out", "/var/log", "/var/log/app/a.log", "out/app"},
+		{"out", "logs/a.log", "logs/a.log", "out"},
+	}
+
+	for _, test := range tests {
+		DstDir = test.dstDir
+		dir, err := treeDstDir(test.root, test.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if dir != filepath.FromSlash(test.expected) {
+			t.Errorf("Expected the output for %v under %v to go in %v but got %v (--dst-dir %q).\n",
+				test.path, test.root, test.expected, dir, test.dstDir)
+		}
+	}
+}
+
+// TestSkipTreeFile tests which files -r leaves alone.
+func TestSkipTreeFile(t *testing.T) {
+
+	defer func() { Mode, DoSkipCompressed = modeAuto, false }()
+
+	gz := []byte{0x1f, 0x8b, 8, 0}
+	text := []byte("plain text")
+
+	tests := []struct {
+		mode           mode
+		skipCompressed bool
+		contents       []byte
+		expected       bool
+	}{
+		{modeAuto, false, snappySignature, true},
+		{modeAuto, false, text, false},
+		{modeAuto, false, gz, false},
+		{modeAuto, true, gz, true},
+		{modeAuto, true, text, false},
+		{modeCompress, false, snappySignature, false},
+		{modeCompress, true, snappySignature, true},
+		{modeDecompress, false, snappySignature, false},
+		{modeDecompress, false, text, true},
+	}
+
+	for _, test := range tests {
+		Mode, DoSkipCompressed = test.mode, test.skipCompressed
+		br, srcIsSz := sniffSz(bytes.NewReader(test.contents))
+		if skipped := skipTreeFile(br, srcIsSz); skipped != test.expected {
+			t.Errorf("Expected %q to be skipped: %v, but got %v (mode %v, --skip-compressed %v).\n",
+				test.contents, test.expected, skipped, test.mode, test.skipCompressed)
+		}
+	}
+
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var errVerify = errors.New("output does not match input")
+
+// Return a hash of the data written to a file with --verify,
+//   or nil without it.
+// The data is hashed as it is read, to check the file against later.
+func newVerifyHash() hash.Hash {
+	if !DoVerify {
+		return nil
+	}
+	return sha256.New()
+}
+
+// Check a file just written against the hash of the data written to it.
+// If `decode` is set, the file is a snappy archive, which is decoded first.
+// Do nothing without --verify.
+func verifyOutput(name string, h hash.Hash, decode bool) error {
+
+	if h == nil {
+		return nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if decode {
+		szr := newParallelReader(file, runtime.GOMAXPROCS(0))
+		defer szr.Close()
+		r = szr
+	}
+
+	return checkHash(r, h)
+}
+
+// Check a file which is still open against the hash of the data
+//   written to it, reading it back from the start.
+// The file needn't be readable once closed, e.g., a read-only file
+//   extracted from a tar archive.
+// Do nothing without --verify.
+func verifyWritten(file *os.File, h hash.Hash) error {
+
+	if h == nil {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return checkHash(file, h)
+}
+
+// Compare the hash of what `r` reads with `h`.
+func checkHash(r io.Reader, h hash.Hash) error {
+
+	written := sha256.New()
+	if _, err := io.Copy(written, r); err != nil {
+		return fmt.Errorf("verifying output: %v", err)
+	}
+	if !bytes.Equal(written.Sum(nil), h.Sum(nil)) {
+		return errVerify
+	}
+
+	return nil
+}
+
+// With --rm, remove a source file once its output `dstName` is safe
+//   on disk.
+// Directories are never removed.
+func removeSource(path string, srcInfo os.FileInfo, dstName string) error {
+
+	if !DoRemove || dstName == "" || path == StdioPath {
+		return nil
+	}
+
+	if srcInfo.IsDir() {
+		printWarning(path, fmt.Errorf("not removing a directory"))
+		return nil
+	}
+
+	if err := syncTree(dstName); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Flush a file, or a directory and everything in it, to disk,
+//   along with the entry for it in its parent directory.
+func syncTree(name string) error {
+
+	err := filepath.Walk(name, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			return syncDir(path)
+		case fi.Mode().IsRegular():
+			return syncFile(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(name))
+}
+
+// Flush a file's contents to disk.
+func syncFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyOutput tests checking output files against their input.
+func TestVerifyOutput(t *testing.T) {
+
+	DoVerify = true
+	defer func() { DoVerify = false }()
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := framingTestData(SnappyMaxUncompressedChunkLen + 10)
+
+	var sz bytes.Buffer
+	if _, err := snap(&sz, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	plainName := filepath.Join(root, "data")
+	szName := filepath.Join(root, "data.sz")
+	if err := ioutil.WriteFile(plainName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(szName, sz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		decode   bool
+		input    []byte
+		expected error
+	}{
+		{plainName, false, data, nil},
+		{szName, true, data, nil},
+		{plainName, false, data[1:], errVerify},
+		{szName, true, append([]byte{1}, data[1:]...), errVerify},
+	}
+
+	for _, test := range tests {
+		h := newVerifyHash()
+		h.Write(test.input)
+		if err := verifyOutput(test.name, h, test.decode); err != test.expected {
+			t.Errorf("Expected verifying %v to return %v but got %v.\n", test.name, test.expected, err)
+		}
+	}
+}
+
+// TestVerifyTar tests that --verify checks tar archives as they are
+//   compressed, and the files extracted from them.
+func TestVerifyTar(t *testing.T) {
+
+	DoVerify = true
+	defer func() { DoVerify = false }()
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string][]byte{
+		"data":     framingTestData(SnappyMaxUncompressedChunkLen + 10),
+		"readonly": []byte("read-only"),
+	}
+
+	srcName := filepath.Join(root, "src", "tree")
+	if err := os.MkdirAll(srcName, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(srcName, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(srcName, "readonly"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	DstDir = filepath.Join(root, "dst")
+	defer func() { DstDir = "" }()
+	if err := os.Mkdir(DstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	szName, err := compressOrDecompress(srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstName, err := compressOrDecompress(szName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		os.Chmod(filepath.Join(dstName, name), 0644)
+		contents, err := ioutil.ReadFile(filepath.Join(dstName, name))
+		if err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("Expected %v to be extracted intact (%v).\n", name, err)
+		}
+	}
+
+	// A file which doesn't match what was written to it is refused.
+	file, err := os.OpenFile(filepath.Join(root, "written"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	h := newVerifyHash()
+	h.Write([]byte("expected"))
+	if err := verifyWritten(file, h); err != errVerify {
+		t.Errorf("Expected %v but got %v.\n", errVerify, err)
+	}
+}
+
+// TestRemoveSource tests that --rm removes files, but not directories,
+//   once their output is written.
+func TestRemoveSource(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcName := filepath.Join(root, "file")
+	dstName := filepath.Join(root, "file.sz")
+	for _, name := range []string{srcName, dstName} {
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcInfo, err := os.Stat(srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep files without --rm.
+	if err := removeSource(srcName, srcInfo, dstName); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(srcName) {
+		t.Errorf("Expected %v to be kept without --rm.\n", srcName)
+	}
+
+	DoRemove = true
+	defer func() { DoRemove = false }()
+
+	if err := removeSource(root, rootInfo, dstName); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(root) {
+		t.Errorf("Expected directory %v to be kept.\n", root)
+	}
+
+	if err := removeSource(srcName, srcInfo, dstName); err != nil {
+		t.Fatal(err)
+	}
+	if exists(srcName) {
+		t.Errorf("Expected %v to be removed.\n", srcName)
+	}
+	if !exists(dstName) {
+		t.Errorf("Expected %v to be kept.\n", dstName)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// A seek table lists the length of every data chunk in a stream,
+//   both compressed and uncompressed, so that a reader can find the
+//   chunk holding any uncompressed offset without decoding the ones
+//   before it.
+// It is stored at the end of the stream in one or more skippable chunks,
+//   which standard snappy decoders ignore.
+// The body of each one is a list of entries followed by a trailer:
+//   entry:   compressed length (3 bytes), uncompressed length (3 bytes)
+//   trailer: offset of the first chunk listed (8 bytes),
+//            number of entries (4 bytes), seekTableMagic (4 bytes)
+// All numbers are little-endian.
+// Compressed lengths include the chunk header.
+// When a stream has too many chunks for one table, the tables are
+//   written one after another, each one listing the chunks after those
+//   listed by the one before it.
+const (
+	chunkTypeSeekTable = 0x99
+	seekTableMagic     = "szst"
+	seekEntryLen       = 6
+	seekTrailerLen     = 16
+	// Largest number of entries which fit in a single chunk.
+	maxSeekEntries = (1<<24 - 1 - seekTrailerLen) / seekEntryLen
+)
+
+var errNoSeekTable = errors.New("no seek table")
+
+// seekEntry is the entry of one data chunk in a seek table.
+type seekEntry struct {
+	compressedLen   int
+	uncompressedLen int
+}
+
+// Return the length of the data a chunk decodes to,
+//   trusting its contents, as the chunk was just encoded.
+func chunkDecodedLen(chunk []byte) int {
+	body := chunk[chunkHeaderLen+chunkChecksumLen:]
+	if chunk[0] == chunkTypeUncompressedData {
+		return len(body)
+	}
+	n, _ := snappy.DecodedLen(body)
+	return n
+}
+
+// Encode the seek table chunk listing `entries`,
+//   the first of which is for the chunk at `offset` in the stream.
+func encodeSeekTable(offset int64, entries []seekEntry) []byte {
+
+	chunkLen := len(entries)*seekEntryLen + seekTrailerLen
+	chunk := make([]byte, chunkHeaderLen, chunkHeaderLen+chunkLen)
+	chunk[0] = chunkTypeSeekTable
+	chunk[1] = uint8(chunkLen >> 0)
+	chunk[2] = uint8(chunkLen >> 8)
+	chunk[3] = uint8(chunkLen >> 16)
+
+	for _, e := range entries {
+		chunk = append(chunk,
+			uint8(e.compressedLen), uint8(e.compressedLen>>8), uint8(e.compressedLen>>16),
+			uint8(e.uncompressedLen), uint8(e.uncompressedLen>>8), uint8(e.uncompressedLen>>16))
+	}
+
+	trailer := make([]byte, seekTrailerLen)
+	binary.LittleEndian.PutUint64(trailer, uint64(offset))
+	binary.LittleEndian.PutUint32(trailer[8:], uint32(len(entries)))
+	copy(trailer[12:], seekTableMagic)
+
+	return append(chunk, trailer...)
+}
+
+// Write the seek table of every chunk written so far.
+func (pw *parallelWriter) writeSeekTable() error {
+
+	offset := pw.dataStart
+	for entries := pw.entries; len(entries) > 0; {
+		n := len(entries)
+		if n > maxSeekEntries {
+			n = maxSeekEntries
+		}
+		if _, err := pw.w.Write(encodeSeekTable(offset, entries[:n])); err != nil {
+			return err
+		}
+		for _, e := range entries[:n] {
+			offset += int64(e.compressedLen)
+		}
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+// Read the seek table chunk which ends at `end`.
+// Return the offset of the first chunk it lists, its entries,
+//   and the offset at which the table chunk itself starts.
+func readSeekTable(r io.ReaderAt, end int64) (int64, []seekEntry, int64, error) {
+
+	if end < chunkHeaderLen+seekTrailerLen {
+		return 0, nil, 0, errNoSeekTable
+	}
+
+	trailer := make([]byte, seekTrailerLen)
+	if _, err := r.ReadAt(trailer, end-seekTrailerLen); err != nil {
+		return 0, nil, 0, err
+	}
+	if string(trailer[12:]) != seekTableMagic {
+		return 0, nil, 0, errNoSeekTable
+	}
+	offset := int64(binary.LittleEndian.Uint64(trailer))
+	n := int64(binary.LittleEndian.Uint32(trailer[8:]))
+
+	chunkLen := n*seekEntryLen + seekTrailerLen
+	start := end - chunkHeaderLen - chunkLen
+	if n > maxSeekEntries || start < 0 {
+		return 0, nil, 0, errNoSeekTable
+	}
+
+	chunk := make([]byte, chunkHeaderLen+chunkLen-seekTrailerLen)
+	if _, err := r.ReadAt(chunk, start); err != nil {
+		return 0, nil, 0, err
+	}
+	header := []byte{chunkTypeSeekTable, uint8(chunkLen), uint8(chunkLen >> 8), uint8(chunkLen >> 16)}
+	if !bytes.Equal(chunk[:chunkHeaderLen], header) {
+		return 0, nil, 0, errNoSeekTable
+	}
+
+	entries := make([]seekEntry, n)
+	for i, b := 0, chunk[chunkHeaderLen:]; i < len(entries); i, b = i+1, b[seekEntryLen:] {
+		entries[i].compressedLen = int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		entries[i].uncompressedLen = int(b[3]) | int(b[4])<<8 | int(b[5])<<16
+	}
+
+	return offset, entries, start, nil
+}
+
+// seekableReader reads the uncompressed contents of a snappy stream
+//   with a seek table at any offset, decoding only the chunks it needs.
+// It is safe for concurrent use, as io.ReaderAt requires.
+type seekableReader struct {
+	r io.ReaderAt
+	// Offsets of each chunk in the stream and of its data once decoded.
+	// Each has one more element than there are chunks, which holds
+	//   the offset of the end of the last chunk.
+	compressedOffsets   []int64
+	uncompressedOffsets []int64
+	// If set, counts the compressed bytes of every chunk decoded.
+	guard *bombGuard
+
+	// The chunk decoded last, kept for reads which follow on from it.
+	mu     sync.Mutex
+	cached int
+	block  []byte
+}
+
+// Return a *seekableReader over the `size` bytes of `r`,
+//   or errNoSeekTable if the stream has no seek table
+//   or does not match the one it has.
+func newSeekableReader(r io.ReaderAt, size int64) (*seekableReader, error) {
+
+	type seekTable struct {
+		offset  int64
+		entries []seekEntry
+	}
+
+	// Read the tables from the last one backwards.
+	var tables []seekTable
+	end := size
+	for {
+		offset, entries, start, err := readSeekTable(r, end)
+		if err == errNoSeekTable && len(tables) != 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tables = append([]seekTable{{offset, entries}}, tables...)
+		end = start
+	}
+
+	sr := &seekableReader{r: r, cached: -1}
+
+	// The chunks listed must run, one after another,
+	//   from the first data chunk of the stream
+	//   up to the last one before the first table.
+	offset := tables[0].offset
+	if err := checkStreamStart(r, offset); err != nil {
+		return nil, err
+	}
+	var uncompressed int64
+	for _, table := range tables {
+		if table.offset != offset {
+			return nil, errNoSeekTable
+		}
+		for _, e := range table.entries {
+			// Every chunk holds at least a header and a checksum,
+			//   and no more than a block of data.
+			if e.compressedLen < chunkHeaderLen+chunkChecksumLen ||
+				e.uncompressedLen > SnappyMaxUncompressedChunkLen {
+				return nil, errNoSeekTable
+			}
+			sr.compressedOffsets = append(sr.compressedOffsets, offset)
+			sr.uncompressedOffsets = append(sr.uncompressedOffsets, uncompressed)
+			offset += int64(e.compressedLen)
+			uncompressed += int64(e.uncompressedLen)
+		}
+	}
+	if err := checkSkippable(r, offset, end); err != nil {
+		return nil, err
+	}
+	sr.compressedOffsets = append(sr.compressedOffsets, offset)
+	sr.uncompressedOffsets = append(sr.uncompressedOffsets, uncompressed)
+
+	return sr, nil
+}
+
+// Make sure a stream starts with a stream identifier
+//   and has nothing but skippable chunks before `dataStart`.
+// Otherwise, e.g., if several streams were concatenated,
+//   its seek table does not cover all of it.
+func checkStreamStart(r io.ReaderAt, dataStart int64) error {
+
+	signature := make([]byte, len(snappySignature))
+	if _, err := r.ReadAt(signature, 0); err != nil || !bytes.Equal(signature, snappySignature) {
+		return errNoSeekTable
+	}
+
+	return checkSkippable(r, int64(len(signature)), dataStart)
+}
+
+// Make sure the chunks from `start` to `end` are all skippable,
+//   e.g., metadata about the original file.
+func checkSkippable(r io.ReaderAt, start int64, end int64) error {
+
+	header := make([]byte, chunkHeaderLen)
+	for offset := start; offset != end; {
+		if offset > end {
+			return errNoSeekTable
+		}
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return errNoSeekTable
+		}
+		if chunkType := header[0]; chunkType < 0x80 || chunkType == chunkTypeStreamIdentifier {
+			return errNoSeekTable
+		}
+		chunkLen := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+		offset += int64(chunkHeaderLen + chunkLen)
+	}
+
+	return nil
+}
+
+// Size returns the length of the uncompressed contents.
+func (sr *seekableReader) Size() int64 {
+	return sr.uncompressedOffsets[len(sr.uncompressedOffsets)-1]
+}
+
+// ReadAt reads uncompressed data starting at offset `off`.
+func (sr *seekableReader) ReadAt(p []byte, off int64) (int, error) {
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	// Find the chunk holding `off`.
+	i := sort.Search(len(sr.uncompressedOffsets), func(i int) bool {
+		return sr.uncompressedOffsets[i] > off
+	}) - 1
+
+	nRead := 0
+	for ; nRead < len(p); i++ {
+		if i >= len(sr.uncompressedOffsets)-1 {
+			return nRead, io.EOF
+		}
+		block, err := sr.chunk(i)
+		if err != nil {
+			return nRead, err
+		}
+		n := copy(p[nRead:], block[off-sr.uncompressedOffsets[i]:])
+		nRead += n
+		off += int64(n)
+	}
+
+	return nRead, nil
+}
+
+// Return the decoded data of the `i`th chunk.
+func (sr *seekableReader) chunk(i int) ([]byte, error) {
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if i == sr.cached {
+		return sr.block, nil
+	}
+
+	chunk := make([]byte, sr.compressedOffsets[i+1]-sr.compressedOffsets[i])
+	if _, err := sr.r.ReadAt(chunk, sr.compressedOffsets[i]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if sr.guard != nil {
+		sr.guard.addIn(len(chunk))
+	}
+
+	if len(chunk) < chunkHeaderLen {
+		return nil, snappy.ErrCorrupt
+	}
+	chunkType := chunk[0]
+	chunkLen := int(chunk[1]) | int(chunk[2])<<8 | int(chunk[3])<<16
+	if chunkType != chunkTypeCompressedData && chunkType != chunkTypeUncompressedData ||
+		chunkLen != len(chunk)-chunkHeaderLen {
+		return nil, snappy.ErrCorrupt
+	}
+
+	block, err := decodeChunk(chunkType, chunk[chunkHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) != sr.uncompressedOffsets[i+1]-sr.uncompressedOffsets[i] {
+		return nil, snappy.ErrCorrupt
+	}
+
+	sr.cached, sr.block = i, block
+
+	return block, nil
+}
+
+// Return a reader over the uncompressed contents of a snappy archive
+//   which can seek using the archive's seek table.
+// If `guard` is not nil, count the compressed bytes of each chunk
+//   decoded with it.
+// Return false if `src` is not a regular file or has no seek table.
+func openSeekable(src *os.File, guard *bombGuard) (*io.SectionReader, bool) {
+
+	fi, err := src.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, false
+	}
+
+	sr, err := newSeekableReader(src, fi.Size())
+	if err != nil {
+		return nil, false
+	}
+	sr.guard = guard
+
+	return io.NewSectionReader(sr, 0, sr.Size()), true
+}
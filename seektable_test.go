@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// Compress data with a seek table.
+func seekableTestStream(t *testing.T, data []byte) []byte {
+
+	var b bytes.Buffer
+	pw := newParallelWriter(&b, 4)
+	pw.indexed = true
+	if _, err := pw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// TestSeekableReader tests that streams with a seek table
+//   are still read by *snappy.Reader and can be read at any offset.
+func TestSeekableReader(t *testing.T) {
+
+	data := framingTestData(5*SnappyMaxUncompressedChunkLen + 123)
+	stream := seekableTestStream(t, data)
+
+	unsnapped, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsnapped, data) {
+		t.Error("Expected *snappy.Reader to decode the stream to its input.")
+	}
+
+	sr, err := newSeekableReader(bytes.NewReader(stream), int64(len(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Size() != int64(len(data)) {
+		t.Errorf("Expected a size of %v but got %v.\n", len(data), sr.Size())
+	}
+
+	reads := []struct {
+		off int64
+		n   int
+	}{
+		{0, 10},
+		{SnappyMaxUncompressedChunkLen - 5, 10},
+		{3*SnappyMaxUncompressedChunkLen + 7, 2*SnappyMaxUncompressedChunkLen + 100},
+		{int64(len(data)) - 20, 20},
+	}
+
+	for _, read := range reads {
+		p := make([]byte, read.n)
+		n, err := sr.ReadAt(p, read.off)
+		if err != nil && err != io.EOF {
+			t.Errorf("Reading %v bytes at %v: %v\n", read.n, read.off, err)
+			continue
+		}
+		if !bytes.Equal(p[:n], data[read.off:read.off+int64(read.n)]) {
+			t.Errorf("Expected %v bytes at %v to match the input.\n", read.n, read.off)
+		}
+	}
+
+	p := make([]byte, 100)
+	if n, err := sr.ReadAt(p, int64(len(data))-50); n != 50 || err != io.EOF {
+		t.Errorf("Expected 50 bytes and io.EOF at the end but got %v bytes and %v.\n", n, err)
+	}
+}
+
+// TestNoSeekTable tests that streams without a seek table, or whose
+//   table does not cover the whole stream, are refused.
+func TestNoSeekTable(t *testing.T) {
+
+	data := framingTestData(3*SnappyMaxUncompressedChunkLen + 10)
+
+	var plain bytes.Buffer
+	pw := newParallelWriter(&plain, 4)
+	if _, err := pw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	seekable := seekableTestStream(t, data)
+	concatenated := append(append([]byte{}, seekable...), seekable...)
+
+	corrupt := append([]byte{}, seekable...)
+	corrupt[len(corrupt)-seekTrailerLen] ^= 1
+
+	// Move the compressed length of the first chunk onto the second,
+	//   so that the lengths still add up but the first is empty.
+	entries := seekTableEntries(t, seekable)
+	entries[1].compressedLen += entries[0].compressedLen
+	entries[0].compressedLen = 0
+	emptyChunk := rewriteSeekTable(seekable, entries)
+
+	// Claim a chunk decodes to more than a block.
+	entries = seekTableEntries(t, seekable)
+	entries[0].uncompressedLen = SnappyMaxUncompressedChunkLen + 1
+	bigChunk := rewriteSeekTable(seekable, entries)
+
+	streams := map[string][]byte{
+		"plain":        plain.Bytes(),
+		"concatenated": concatenated,
+		"corrupt":      corrupt,
+		"empty chunk":  emptyChunk,
+		"big chunk":    bigChunk,
+	}
+
+	for name, stream := range streams {
+		if _, err := newSeekableReader(bytes.NewReader(stream), int64(len(stream))); err != errNoSeekTable {
+			t.Errorf("Expected %v stream to have no seek table but got %v.\n", name, err)
+		}
+	}
+}
+
+// Return the entries of the single seek table at the end of a stream.
+func seekTableEntries(t *testing.T, stream []byte) []seekEntry {
+	_, entries, _, err := readSeekTable(bytes.NewReader(stream), int64(len(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// Return a copy of a stream with its single seek table
+//   replaced by one listing `entries`.
+func rewriteSeekTable(stream []byte, entries []seekEntry) []byte {
+	table := encodeSeekTable(int64(len(snappySignature)), entries)
+	rewritten := append([]byte{}, stream[:len(stream)-len(table)]...)
+	return append(rewritten, table...)
+}
+
+// TestSeekableReaderShortChunk tests that a chunk too short to hold
+//   a header is reported as corrupt rather than read past its end.
+func TestSeekableReaderShortChunk(t *testing.T) {
+
+	stream := seekableTestStream(t, framingTestData(10))
+
+	sr := &seekableReader{
+		r:                   bytes.NewReader(stream),
+		compressedOffsets:   []int64{int64(len(snappySignature)), int64(len(snappySignature)) + 2},
+		uncompressedOffsets: []int64{0, 10},
+		cached:              -1,
+	}
+
+	if _, err := sr.ReadAt(make([]byte, 10), 0); err != snappy.ErrCorrupt {
+		t.Errorf("Expected %v but got %v.\n", snappy.ErrCorrupt, err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sparseEntry is a region of data in a file with holes.
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// Length of a tar block.
+const tarBlockLen = 512
+
+// Offsets of the fields of a tar header block which are rewritten here.
+const (
+	tarSizeOffset     = 124
+	tarSizeLen        = 12
+	tarChecksumOffset = 148
+	tarChecksumLen    = 8
+	tarTypeOffset     = 156
+)
+
+// https://www.gnu.org/software/tar/manual/html_section/Sparse-Formats.html
+// Write a file with holes to a tar archive as a GNU sparse 1.0 entry,
+//   storing only the regions in `data`.
+// The tar writer can read such entries but not write them,
+//   so the entry is written to the tar stream under it directly.
+func (t *tarchive) writeSparse(hdr *tar.Header, file *os.File, data []sparseEntry) error {
+
+	// The entry's data starts with its sparse map:
+	//   the number of regions, then the offset and length of each one.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(data))
+	stored := int64(0)
+	for _, e := range data {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", e.offset, e.length)
+		stored += e.length
+	}
+	sparseMap.Write(make([]byte, tarPadding(int64(sparseMap.Len()))))
+	stored += int64(sparseMap.Len())
+
+	// Readers which don't understand sparse entries
+	//   extract the raw data under a name like GNU tar's.
+	sparseHdr := *hdr
+	sparseHdr.Name = path.Join(path.Dir(hdr.Name), "GNUSparseFile.0", path.Base(hdr.Name))
+	sparseHdr.Size = stored
+	sparseHdr.Format = tar.FormatPAX
+
+	blocks, err := sparseHeader(&sparseHdr, map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Finish the previous entry before writing around the tar writer.
+	if err := t.writer.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := t.raw.Write(blocks); err != nil {
+		return err
+	}
+	if _, err := t.raw.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+	for _, e := range data {
+		region := io.NewSectionReader(file, e.offset, e.length)
+		if _, err := io.CopyN(t.raw, region, e.length); err != nil {
+			return err
+		}
+	}
+
+	_, err = t.raw.Write(make([]byte, tarPadding(stored)))
+	return err
+}
+
+// Return the header blocks of a tar entry,
+//   with extra PAX records which the tar writer won't write itself.
+func sparseHeader(hdr *tar.Header, records map[string]string) ([]byte, error) {
+
+	// Let the tar writer encode the header,
+	//   including any PAX records it needs, e.g., for long names or xattrs.
+	var b bytes.Buffer
+	if err := tar.NewWriter(&b).WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	raw := b.Bytes()
+	entryBlock := raw[len(raw)-tarBlockLen:]
+
+	// Merge its PAX records, if any, with the extra ones.
+	paxBlock := make([]byte, tarBlockLen)
+	copy(paxBlock, entryBlock)
+	var pax []byte
+	if len(raw) > tarBlockLen && raw[tarTypeOffset] == tar.TypeXHeader {
+		copy(paxBlock, raw[:tarBlockLen])
+		size, err := strconv.ParseInt(strings.Trim(
+			string(raw[tarSizeOffset:tarSizeOffset+tarSizeLen]), " \x00"), 8, 64)
+		if err != nil {
+			return nil, err
+		}
+		pax = append(pax, raw[tarBlockLen:tarBlockLen+size]...)
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pax = append(pax, paxRecord(key, records[key])...)
+	}
+
+	// Write a single PAX header with every record,
+	//   since a reader only uses the last one before an entry.
+	paxBlock[tarTypeOffset] = tar.TypeXHeader
+	copy(paxBlock[tarSizeOffset:], fmt.Sprintf("%0*o\x00", tarSizeLen-1, len(pax)))
+	setTarChecksum(paxBlock)
+
+	blocks := append(paxBlock, pax...)
+	blocks = append(blocks, make([]byte, tarPadding(int64(len(pax))))...)
+	return append(blocks, entryBlock...), nil
+}
+
+// Encode a PAX record as "<length> <key>=<value>\n",
+//   where the length includes itself.
+func paxRecord(key string, value string) string {
+	size := len(key) + len(value) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, key, value)
+	if len(record) != size {
+		// Adding the length made the length one digit longer.
+		size = len(record)
+		record = fmt.Sprintf("%d %s=%s\n", size, key, value)
+	}
+	return record
+}
+
+// Set the checksum of a tar header block.
+func setTarChecksum(block []byte) {
+	field := block[tarChecksumOffset : tarChecksumOffset+tarChecksumLen]
+	copy(field, "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(field, fmt.Sprintf("%06o\x00 ", sum))
+}
+
+// Return the number of bytes needed to pad `n` bytes to a tar block.
+func tarPadding(n int64) int64 {
+	return -n & (tarBlockLen - 1)
+}
+
+// Length of the blocks checked for zeros by a *sparseWriter.
+const sparseBlockLen = 4096
+
+var zeroBlock = make([]byte, sparseBlockLen)
+
+// sparseWriter writes to a file, seeking over blocks of zeros
+//   instead of writing them, so that they become holes.
+// finish must be called once everything has been written.
+type sparseWriter struct {
+	file *os.File
+	// Bytes written or skipped so far.
+	size int64
+}
+
+// Write writes `p`, skipping any whole blocks of zeros.
+// Blocks line up with those of the file.
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+
+	nWritten := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if blockLeft := sparseBlockLen - int(sw.size%sparseBlockLen); len(chunk) > blockLeft {
+			chunk = p[:blockLeft]
+		}
+
+		if len(chunk) == sparseBlockLen && bytes.Equal(chunk, zeroBlock) {
+			if _, err := sw.file.Seek(sparseBlockLen, io.SeekCurrent); err != nil {
+				return nWritten, err
+			}
+		} else if _, err := sw.file.Write(chunk); err != nil {
+			return nWritten, err
+		}
+
+		sw.size += int64(len(chunk))
+		nWritten += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return nWritten, nil
+}
+
+// Set the size of the file, in case it ends with a hole.
+func (sw *sparseWriter) finish() error {
+	return sw.file.Truncate(sw.size)
+}
+
+// Return a writer for the contents of a new file.
+// With --sparse, blocks of zeros are skipped to leave holes in the file.
+// The returned func must be called once everything has been written.
+func contentWriter(file *os.File) (io.Writer, func() error) {
+	if !DoSparse {
+		return file, func() error { return nil }
+	}
+	sw := &sparseWriter{file: file}
+	return sw, sw.finish
+}
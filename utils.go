@@ -1,13 +1,21 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"io"
+	"math"
 	"mime"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
 )
 
 // Concatenate strings.
@@ -29,63 +37,355 @@ func isDir(file *os.File) bool {
 	return fi.IsDir()
 }
 
-// Check a file's contents for a snappy file signature.
-func isSz(file *os.File) bool {
-
-	snappySignature := []byte{255, 6, 0, 0, 115, 78, 97, 80, 112, 89}
-	offset := int64(0)
+// The stream identifier chunk at the start of every snappy stream.
+var snappySignature = []byte{255, 6, 0, 0, 115, 78, 97, 80, 112, 89}
 
-	lenSignature := len(snappySignature)
-	chunk := make([]byte, lenSignature)
+// Check a buffered stream's contents for a snappy file signature.
+// The signature is peeked at, so no data is consumed from the stream.
+func isSz(br *bufio.Reader) bool {
 
-	nRead, _ := file.ReadAt(chunk, offset)
-	if nRead < lenSignature {
+	chunk, err := br.Peek(len(snappySignature))
+	if err != nil {
 		return false
 	}
 
 	return bytes.Equal(chunk, snappySignature)
 }
 
-// Check a file's contents for a tar file signature.
-func isTar(file *os.File) bool {
+// Wrap a reader in a buffer and check it for a snappy file signature.
+// Return the buffered reader, which must be used in place of `r`
+//   from then on.
+func sniffSz(r io.Reader) (*bufio.Reader, bool) {
+	br := bufio.NewReader(r)
+	return br, isSz(br)
+}
+
+// Check a buffered stream's contents for a tar file signature.
+// The signature is peeked at, so no data is consumed from the stream.
+func isTar(br *bufio.Reader) bool {
 
 	tarSignature := []byte{117, 115, 116, 97, 114}
-	offset := int64(257)
-
-	lenSignature := len(tarSignature)
-	chunk := make([]byte, lenSignature)
+	offset := 257
 
-	nRead, _ := file.ReadAt(chunk, offset)
-	if nRead < lenSignature {
+	chunk, err := br.Peek(offset + len(tarSignature))
+	if err != nil {
 		return false
 	}
 
-	return bytes.Equal(chunk, tarSignature)
+	return bytes.Equal(chunk[offset:], tarSignature)
+}
+
+// Check the contents of a reader for a tar file signature.
+func isTarAt(r io.ReaderAt) bool {
+	return isTar(bufio.NewReader(io.NewSectionReader(r, 0, 512)))
+}
+
+// Wrap a reader in a buffer and check it for a tar file signature.
+// Return the buffered reader, which must be used in place of `r`
+//   from then on.
+func sniffTar(r io.Reader) (*bufio.Reader, bool) {
+	br := bufio.NewReader(r)
+	return br, isTar(br)
 }
 
-// Create a file if it doesn't exist. Otherwise, just open it.
-func create(filename string, mode os.FileMode) (*os.File, error) {
-	// unusedPath(&filename)
-	file, err := os.OpenFile(
-		filename,
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		mode,
-	)
-	return file, err
+// Check whether an error was caused by corrupt input.
+func isCorrupt(err error) bool {
+	switch err {
+	case snappy.ErrCorrupt, snappy.ErrUnsupported, tar.ErrHeader, io.ErrUnexpectedEOF,
+		errSizeMismatch, errDigestMismatch, errDigestMissing:
+		return true
+	}
+	return false
 }
 
+// Open a file for reading, or return stdin if `path` is StdioPath.
+func openPath(path string) (*os.File, error) {
+	if path == StdioPath {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// Give a file the permissions and timestamps of another file.
+// If running as root, give it the same ownership as well.
+// Do nothing if the user passed --no-preserve.
+func preserve(dstName string, srcInfo os.FileInfo) error {
+
+	if !DoPreserve {
+		return nil
+	}
+
+	// Change the ownership first, since it may clear setuid bits.
+	if isRoot := (os.Geteuid() == 0); isRoot {
+		if uid, gid, ok := fileOwner(srcInfo); ok {
+			if err := os.Lchown(dstName, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := srcInfo.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(dstName, mode); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dstName, atime(srcInfo), srcInfo.ModTime())
+}
+
+// Create a new file, never opening one that already exists.
+// If the name is taken, a numbered variant of it is used instead.
+// Return the file and the name it was created under.
+func create(filename string, mode os.FileMode) (*os.File, string, error) {
+
+	var file *os.File
+
+	name, err := claimUnusedPath(filename, func(name string) error {
+		var err error
+		file, err = os.OpenFile(
+			name,
+			os.O_RDWR|os.O_CREATE|os.O_EXCL,
+			mode,
+		)
+		return err
+	})
+
+	return file, name, err
+}
+
+// Create a new directory, never reusing one that already exists.
+// If the name is taken, a numbered variant of it is used instead.
+// Return the name the directory was created under.
+func mkdirUnused(dirname string, mode os.FileMode) (string, error) {
+	return claimUnusedPath(dirname, func(name string) error {
+		return os.Mkdir(name, mode)
+	})
+}
+
+// Temporary files and directories which have not been moved into place.
+// The lock is held while a temporary is created and registered,
+//   so an interrupt cannot miss one.
+var temps = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// Counts temporary names, which must differ between goroutines.
+var tempCounter uint32
+
+// Return a hidden name in the same directory as `filename`,
+//   unique to this process.
+func tempPath(filename string) string {
+	dir, base := filepath.Split(filename)
+	n := atomic.AddUint32(&tempCounter, 1)
+	pid := os.Getpid()
+	return filepath.Join(dir, concat(".", base, ".", strconv.Itoa(pid), "-", strconv.FormatUint(uint64(n), 10), ".snapzip"))
+}
+
+// Claim a hidden, temporary name next to `filename` with `claim`,
+//   which must fail with an error satisfying os.IsExist
+//   if the name is already taken.
+// Remember the name so it can be removed if the program is interrupted.
+func claimTempPath(filename string, claim func(name string) error) (string, error) {
+
+	temps.Lock()
+	defer temps.Unlock()
+
+	for {
+		name := tempPath(filename)
+		err := claim(name)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		temps.names[name] = true
+		return name, nil
+	}
+}
+
+// Create a hidden, temporary directory next to `dirname`.
+func mkdirTemp(dirname string) (string, error) {
+	return claimTempPath(dirname, func(name string) error {
+		return os.Mkdir(name, 0755)
+	})
+}
+
+// Remove a temporary file or directory unless it has been moved into place.
+// Safe to defer.
+func removeTemp(name string) {
+	temps.Lock()
+	defer temps.Unlock()
+
+	if temps.names[name] {
+		removeAll(name)
+		delete(temps.names, name)
+	}
+}
+
+// Remove every temporary file or directory.
+// The lock is never released, so no more can be created
+//   before the program exits.
+func removeTemps() {
+	temps.Lock()
+	for name := range temps.names {
+		removeAll(name)
+	}
+}
+
+// Remove a file or directory and everything in it.
+// Let the owner into each directory first,
+//   e.g., one extracted read-only from a tar archive.
+func removeAll(name string) error {
+
+	filepath.Walk(name, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && fi.Mode().Perm()&0700 != 0700 {
+			os.Chmod(path, fi.Mode().Perm()|0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(name)
+}
+
+// Move a temporary file or directory to `filename`,
+//   or to a numbered variant of it if the name is taken.
+// Never replace anything already there.
+// Return the name it was moved to.
+func moveUnused(tmpName string, filename string) (string, error) {
+
+	fi, err := os.Lstat(tmpName)
+	if err != nil {
+		return "", err
+	}
+
+	var name string
+
+	if fi.IsDir() {
+		// Claim the name with an empty directory,
+		//   which a POSIX rename replaces atomically.
+		name, err = mkdirUnused(filename, 0700)
+		if err != nil {
+			return "", err
+		}
+		if err = os.Rename(tmpName, name); err != nil {
+			// Other systems refuse, so free the name and try again.
+			os.Remove(name)
+			if err = os.Rename(tmpName, name); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		// A hard link can't replace anything, unlike a rename.
+		linked := false
+		name, err = claimUnusedPath(filename, func(name string) error {
+			err := os.Link(tmpName, name)
+			linked = (err == nil)
+			if !linkUnsupported(err) {
+				return err
+			}
+			return renameUnused(tmpName, name)
+		})
+		if err != nil {
+			return "", err
+		}
+		if linked {
+			if err = os.Remove(tmpName); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	temps.Lock()
+	delete(temps.names, tmpName)
+	temps.Unlock()
+
+	return name, nil
+}
+
+// Serializes renameUnused, so goroutines can't take the same name.
+var renameLock sync.Mutex
+
+// Rename a file to `name` unless something is already there,
+//   for filesystems which don't support hard links.
+// Unlike a hard link, this can't stop another process
+//   from taking the name between the check and the rename.
+func renameUnused(tmpName string, name string) error {
+
+	renameLock.Lock()
+	defer renameLock.Unlock()
+
+	if _, err := os.Lstat(name); !os.IsNotExist(err) {
+		if err == nil {
+			err = &os.LinkError{Op: "rename", Old: tmpName, New: name, Err: os.ErrExist}
+		}
+		return err
+	}
+
+	return os.Rename(tmpName, name)
+}
+
+// pendingFile is an output file which is written under a hidden,
+//   temporary name and moved to its final name once it is complete.
+// A partial file never appears under the final name.
+type pendingFile struct {
+	*os.File
+	dstName string
+}
+
+// Create a hidden, temporary file which will become `dstName`.
+func createPending(dstName string, mode os.FileMode) (*pendingFile, error) {
+
+	var file *os.File
+
+	_, err := claimTempPath(dstName, func(name string) error {
+		var err error
+		file, err = os.OpenFile(
+			name,
+			os.O_RDWR|os.O_CREATE|os.O_EXCL,
+			mode,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingFile{File: file, dstName: dstName}, nil
+}
+
+// Move a finished, closed file to its final name,
+//   or to a numbered variant of it if the name is taken.
+// Return the name it was moved to.
+func (f *pendingFile) commit() (string, error) {
+	return moveUnused(f.Name(), f.dstName)
+}
+
+// Close and remove the file unless it has been committed.
+// Safe to defer.
+func (f *pendingFile) abort() {
+	f.Close()
+	removeTemp(f.Name())
+}
+
+// Place a destination name under 'DstDir' if the user set one.
 func setDstName(dstName *string) {
 	if customDst := (DstDir != ""); customDst {
 		*dstName = path.Join(DstDir, *dstName)
 	}
-	*dstName = unusedPath(*dstName)
 }
 
-// Modify a filename to one that has not been used by the system.
-func unusedPath(filename string) string {
-
-	if !exists(filename) {
-		return filename
+// Claim a filename, or a variant of it which has not been used by the system.
+// `claim` must create the file atomically and fail with an error
+//   satisfying os.IsExist if the name is already taken,
+//   e.g., by opening it with O_EXCL.
+// This way, no two goroutines or processes can claim the same name.
+// Return the name that was claimed.
+func claimUnusedPath(filename string, claim func(name string) error) (string, error) {
+
+	err := claim(filename)
+	if !os.IsExist(err) {
+		return filename, err
 	}
 
 	base, ext := splitExt(filename)
@@ -94,13 +394,14 @@ func unusedPath(filename string) string {
 		// May change this convention later,
 		//   since bash does not like the parentheses.
 		testname := concat(base, "(", strconv.Itoa(i), ")", ext)
-		if exists(testname) {
+		err := claim(testname)
+		if os.IsExist(err) {
 			continue // recursive case
 		}
-		return testname // base case
+		return testname, err // base case
 	}
 
-	return filename
+	return "", err
 }
 
 // Split the extension off a filename.
@@ -140,6 +441,50 @@ func isExtension(ext string) bool {
 	return false
 }
 
+// Check whether stdin is a pipe or a file rather than a terminal.
+func stdinIsPipe() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
+// Parse a size in bytes, optionally followed by a binary unit,
+//   e.g., "4096", "64K", "512M", "2G", or "1TiB".
+func parseSize(s string) (uint64, error) {
+
+	units := []struct {
+		suffix string
+		size   uint64
+	}{
+		{"T", 1 << 40},
+		{"G", 1 << 30},
+		{"M", 1 << 20},
+		{"K", 1 << 10},
+	}
+
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	multiplier := uint64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(num, unit.suffix) {
+			num = strings.TrimSuffix(num, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/multiplier {
+		return 0, &strconv.NumError{Func: "parseSize", Num: s, Err: strconv.ErrRange}
+	}
+
+	return n * multiplier, nil
+}
+
 // Check whether a file exists.
 func exists(filename string) bool {
 	if _, err := os.Stat(filename); err == nil {
@@ -159,15 +504,6 @@ func fmtDir(name *string) {
 	}
 }
 
-// Return the total size in bytes and number of files under a directory.
-func dirSize(dir string) (i int) {
-	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
-		i++
-		return nil
-	})
-	return
-}
-
 // Return a slice of all the paths under a directory.
 func getPaths(dir string) (paths []string) {
 	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPreserve tests that preserve gives a file the permissions
+//   and modification time of another, unless --no-preserve was given.
+func TestPreserve(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func() { DoPreserve = true }()
+
+	srcName := filepath.Join(root, "src")
+	if err := ioutil.WriteFile(srcName, []byte("src"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chmod(srcName, 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(srcName, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	srcInfo, err := os.Stat(srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, doPreserve := range []bool{true, false} {
+		DoPreserve = doPreserve
+
+		dstName := filepath.Join(root, "dst")
+		os.Remove(dstName)
+		if err := ioutil.WriteFile(dstName, []byte("dst"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := preserve(dstName, srcInfo); err != nil {
+			t.Fatal(err)
+		}
+
+		dstInfo, err := os.Stat(dstName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preserved := dstInfo.Mode() == srcInfo.Mode() && dstInfo.ModTime().Equal(modTime)
+		if preserved != doPreserve {
+			t.Errorf("With DoPreserve %v, got mode %v and mtime %v.\n",
+				doPreserve, dstInfo.Mode(), dstInfo.ModTime())
+		}
+	}
+}
+
+// TestCreateConcurrent tests that files created at once under the same name
+//   are each given a name of their own, and never one which was taken.
+func TestCreateConcurrent(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	filename := filepath.Join(root, "file.txt")
+	if err := ioutil.WriteFile(filename, []byte("taken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 16
+	names := make(chan string, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, name, err := create(filename, 0644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer file.Close()
+			if _, err := file.WriteString(strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+			names <- name
+		}(i)
+	}
+	wg.Wait()
+	close(names)
+
+	seen := make(map[string]bool)
+	for name := range names {
+		if seen[name] || name == filename {
+			t.Errorf("Expected %v to be created only once.\n", name)
+		}
+		seen[name] = true
+
+		// Each file holds only what was written to it.
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strconv.Atoi(string(contents)); err != nil {
+			t.Errorf("Expected %v to hold one number but got %q.\n", name, contents)
+		}
+	}
+
+	if contents, _ := ioutil.ReadFile(filename); string(contents) != "taken" {
+		t.Errorf("Expected the existing file to be left alone but got %q.\n", contents)
+	}
+}
+
+// TestCreatePendingConcurrent tests that pending files committed at once
+//   under the same name are each moved to a name of their own,
+//   and that no temporary file is left behind.
+func TestCreatePendingConcurrent(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dstName := filepath.Join(root, "file.txt")
+
+	const n = 16
+	names := make(chan string, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := createPending(dstName, 0644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer file.abort()
+			if _, err := file.WriteString(strconv.Itoa(i)); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := file.Close(); err != nil {
+				t.Error(err)
+				return
+			}
+			name, err := file.commit()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			names <- name
+		}(i)
+	}
+	wg.Wait()
+	close(names)
+
+	seen := make(map[string]bool)
+	for name := range names {
+		if seen[name] {
+			t.Errorf("Expected %v to be committed only once.\n", name)
+		}
+		seen[name] = true
+
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strconv.Atoi(string(contents)); err != nil {
+			t.Errorf("Expected %v to hold one number but got %q.\n", name, contents)
+		}
+	}
+
+	left, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != len(seen) {
+		t.Errorf("Expected %v files but found %v.\n", len(seen), len(left))
+	}
+}
+
+// TestRenameUnused tests that a file is only renamed to a name
+//   which is free, for filesystems without hard links.
+func TestRenameUnused(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tmpName := filepath.Join(root, ".file.snapzip")
+	name := filepath.Join(root, "file")
+	for _, filename := range []string{tmpName, name} {
+		if err := ioutil.WriteFile(filename, []byte(filename), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := renameUnused(tmpName, name); !os.IsExist(err) {
+		t.Errorf("Expected the name to be taken but got %v.\n", err)
+	}
+	if contents, _ := ioutil.ReadFile(name); string(contents) != name {
+		t.Errorf("Expected %v to be left alone but got %q.\n", name, contents)
+	}
+
+	free := filepath.Join(root, "file(1)")
+	if err := renameUnused(tmpName, free); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(free); string(contents) != tmpName {
+		t.Errorf("Expected %v to be renamed but got %q.\n", tmpName, contents)
+	}
+}
+
+// TestRemoveAll tests that read-only directories are removed
+//   along with everything in them.
+func TestRemoveAll(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "snapzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "ro", "sub")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{dir, filepath.Dir(dir)} {
+		if err := os.Chmod(name, 0555); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removeAll(filepath.Join(root, "ro")); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(root, "ro")) {
+		t.Error("Expected the read-only directory to be removed.")
+	}
+}